@@ -15,7 +15,8 @@ import (
 	"github.com/containers/podman/v6/pkg/domain/entities"
 )
 
-func Build(socket string, containerConfig config.ContainerConfig, layers bool, verbose bool) {
+// Builds the image, failures are returned so updates can report them with the other images
+func Build(socket string, containerConfig config.ContainerConfig, layers bool, verbose bool) error {
 	var conn context.Context = podman.InitializePodman(socket)
 	var options entities.BuildOptions
 	var commonBuildOptions define.CommonBuildOptions
@@ -28,37 +29,70 @@ func Build(socket string, containerConfig config.ContainerConfig, layers bool, v
 	// Create temporary Dockerfile
 	dockerFile, err := os.CreateTemp("", fmt.Sprintf("sandman_build_%s", strings.Replace(containerConfig.Name, "/", "_", -1)))
 	if err != nil {
-		fmt.Println("Failed to write to temp dockerfile")
-		fmt.Println("Error: ", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to write to temp dockerfile: %w", err)
 	}
 	defer os.Remove(dockerFile.Name())
 	defer dockerFile.Close()
 
 	// Write instructions to Dockerfile
 	if _, err := dockerFile.Write([]byte(containerConfig.Build.Instructions)); err != nil {
-		fmt.Println("Failed to write to temp dockerfile")
-		fmt.Println("Error: ", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to write to temp dockerfile: %w", err)
+	}
+
+	versionTag, err := NewVersionTag(conn, containerConfig.ImageName)
+	if err != nil {
+		return fmt.Errorf("failed to tag the build: %w", err)
 	}
 
 	// Image paramenters
 	options.Layers = layers
 	options.Output = containerConfig.ImageName
-	if containerConfig.Build.ContextDirectory == "" {
-		options.ContextDirectory = config.GetSandmanConfigDir()
-	} else {
-		options.ContextDirectory = containerConfig.Build.ContextDirectory
-	}
+	options.AdditionalTags = append(options.AdditionalTags, VersionReference(containerConfig.ImageName, versionTag))
 	options.AdditionalTags = append(options.AdditionalTags, containerConfig.Build.AdditionalImageNames...)
 	options.Labels = append(options.Labels,
 		fmt.Sprintf("sandman_version=%s", constants.VERSION),
 		fmt.Sprintf("sandman_image_name=%s", containerConfig.ImageName),
 		fmt.Sprintf("sandman_container_name=%s", containerConfig.Name),
+		fmt.Sprintf("sandman_build_tag=%s", versionTag),
 	)
+	options.Labels = append(options.Labels, Labels(containerConfig.Build.Labels)...)
 
 	// Set building parameters
-	commonBuildOptions.Ulimit = containerConfig.Build.Limits.Ulimit
+	if err := LimitOptions(&commonBuildOptions, containerConfig.Build.Limits); err != nil {
+		return fmt.Errorf("invalid build limits: %w", err)
+	}
+
+	// Isolation and caching
+	if err := NetworkOptions(&options.BuildOptions, containerConfig.Build.Network); err != nil {
+		return fmt.Errorf("invalid build network: %w", err)
+	}
+	if options.PullPolicy, err = PullPolicy(containerConfig.Build.Pull); err != nil {
+		return fmt.Errorf("invalid pull policy: %w", err)
+	}
+	options.NoCache = containerConfig.Build.NoCache
+	options.Squash = containerConfig.Build.Squash
+
+	// Secrets are only exposed to RUN --mount=type=secret, never stored in a layer
+	secrets, secretFiles, err := Secrets(containerConfig)
+	if err != nil {
+		return fmt.Errorf("failed to prepare build secrets: %w", err)
+	}
+	defer RemoveFiles(secretFiles)
+	commonBuildOptions.Secrets = secrets
+
+	// Persistent volumes mounted in every RUN, e.g. package manager caches
+	if commonBuildOptions.Volumes, err = CacheVolumes(containerConfig); err != nil {
+		return fmt.Errorf("failed to prepare build cache volumes: %w", err)
+	}
+
+	// Context directory, merged with inline files if any
+	contextDirectory, removeContext, err := ContextDirectory(containerConfig)
+	if err != nil {
+		return fmt.Errorf("failed to prepare build context: %w", err)
+	}
+	defer removeContext()
+	options.ContextDirectory = contextDirectory
+
 	options.CommonBuildOpts = &commonBuildOptions
 	options.Compression = containerConfig.Build.Compression
 
@@ -69,14 +103,26 @@ func Build(socket string, containerConfig config.ContainerConfig, layers bool, v
 	buildReport, err := images.Build(conn, []string{dockerFile.Name()}, options)
 
 	if err != nil {
-		fmt.Println("Failed to build image")
-		fmt.Println("Error: ", err)
-	} else if verbose {
+		return fmt.Errorf("failed to build image: %w", err)
+	}
+
+	if verbose {
 		fmt.Println("Build report: ", *buildReport)
 	}
+
+	fmt.Printf("Built %s\n", VersionReference(containerConfig.ImageName, versionTag))
+	Prune(conn, containerConfig.ImageName, containerConfig.Build.Retention, verbose)
+
+	return nil
 }
 
-func CmdExecute(socket string, verbose bool, layers bool, args []string) {
+func CmdExecute(socket string, verbose bool, layers bool, flags Flags, args []string) {
 	var container_name string = args[0]
-	Build(socket, config.LoadConfig(container_name), layers, verbose)
+	var containerConfig config.ContainerConfig = config.LoadConfig(container_name)
+	flags.Apply(&containerConfig.Build)
+	if err := Build(socket, containerConfig, layers, verbose); err != nil {
+		fmt.Println("Failed to build image")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
 }
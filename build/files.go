@@ -0,0 +1,109 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/julioln/sandman/config"
+
+	"go.podman.io/storage/pkg/archive"
+)
+
+const defaultFileMode = 0644
+
+func fileMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return defaultFileMode, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %s, expected octal (e.g. 0644)", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// Replaces a file of the context. An existing file or symlink is removed first, so the content is never written
+// to what it points to
+func writeContextFile(root *os.Root, path string, content []byte, mode os.FileMode) error {
+	if err := root.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := root.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	file, err := root.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	// The umask applies on creation
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Returns the build context directory. When inline files are declared, they are written to a temporary
+// copy of the context directory, which must be removed with the returned function after the build.
+func ContextDirectory(containerConfig config.ContainerConfig) (string, func(), error) {
+	var contextDirectory string = containerConfig.Build.ContextDirectory
+	if contextDirectory == "" {
+		contextDirectory = config.GetSandmanConfigDir()
+	}
+
+	if len(containerConfig.Build.Files) == 0 {
+		return contextDirectory, func() {}, nil
+	}
+
+	tempDirectory, err := os.MkdirTemp("", fmt.Sprintf("sandman_context_%s", strings.Replace(containerConfig.Name, "/", "_", -1)))
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(tempDirectory)
+	}
+
+	if err := archive.NewDefaultArchiver().CopyWithTar(contextDirectory, tempDirectory); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	// Written through the copied context as a root, so symlinks it contains can't point the files elsewhere
+	root, err := os.OpenRoot(tempDirectory)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	defer root.Close()
+
+	for path, file := range containerConfig.Build.Files {
+		// Files can't escape the context
+		if !filepath.IsLocal(path) {
+			cleanup()
+			return "", nil, fmt.Errorf("invalid file path %s, must be relative to the context", path)
+		}
+
+		mode, err := fileMode(file.Mode)
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+
+		if err := writeContextFile(root, path, []byte(file.Content), mode); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+
+	return tempDirectory, cleanup, nil
+}
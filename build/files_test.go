@@ -0,0 +1,111 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julioln/sandman/config"
+)
+
+// A context with symlinks to a directory and a file outside of it
+func testContext(t *testing.T) (string, string) {
+	context := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(context, "Containerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(context, "outside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "config"), filepath.Join(context, "config")); err != nil {
+		t.Fatal(err)
+	}
+	return context, outside
+}
+
+func TestContextDirectory(t *testing.T) {
+	context, _ := testContext(t)
+	testConfig := new(config.ContainerConfig)
+	testConfig.Build.ContextDirectory = context
+
+	// Without files, the context is used as is
+	directory, cleanup, err := ContextDirectory(*testConfig)
+	if err != nil || directory != context {
+		t.Fatalf("expected the context %s, got %s (%v)", context, directory, err)
+	}
+	cleanup()
+
+	testConfig.Build.Files = map[string]config.ContainerConfigBuildFile{
+		"settings.conf":    {Content: "default"},
+		"bin/entrypoint":   {Content: "#!/bin/sh\n", Mode: "0755"},
+		"secrets/key.conf": {Content: "key", Mode: "600"},
+		"config":           {Content: "replaced"},
+	}
+	directory, cleanup, err = ContextDirectory(*testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if directory == context {
+		t.Fatalf("expected a copy of the context")
+	}
+
+	modes := map[string]os.FileMode{"settings.conf": 0644, "bin/entrypoint": 0755, "secrets/key.conf": 0600, "config": 0644}
+	for path, mode := range modes {
+		info, err := os.Lstat(filepath.Join(directory, path))
+		if err != nil {
+			t.Errorf("file %s not written: %v", path, err)
+			continue
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm() != mode {
+			t.Errorf("file %s, expected mode %v, got %v", path, mode, info.Mode())
+		}
+		content, _ := os.ReadFile(filepath.Join(directory, path))
+		if string(content) != testConfig.Build.Files[path].Content {
+			t.Errorf("file %s, expected %q, got %q", path, testConfig.Build.Files[path].Content, content)
+		}
+	}
+
+	cleanup()
+	if _, err := os.Stat(directory); err == nil {
+		t.Errorf("context copy %s not removed", directory)
+	}
+}
+
+func TestContextDirectoryRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		mode string
+	}{
+		{"parent", "../escaped", ""},
+		{"nested parent", "bin/../../escaped", ""},
+		{"absolute", "/tmp/escaped", ""},
+		{"symlink escaping the root", "outside/escaped", ""},
+		{"invalid mode", "settings.conf", "rwxr-xr-x"},
+		{"non octal mode", "settings.conf", "0999"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			context, outside := testContext(t)
+			testConfig := new(config.ContainerConfig)
+			testConfig.Build.ContextDirectory = context
+			testConfig.Build.Files = map[string]config.ContainerConfigBuildFile{
+				test.path: {Content: "escaped", Mode: test.mode},
+			}
+
+			directory, cleanup, err := ContextDirectory(*testConfig)
+			if err == nil {
+				cleanup()
+				t.Fatalf("expected %s to be refused, got %s", test.path, directory)
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+				t.Errorf("written outside of the context: %v", entries)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(context), "escaped")); err == nil {
+				t.Errorf("written next to the context")
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/julioln/sandman/config"
+
+	"github.com/containers/buildah/define"
+	"github.com/docker/go-units"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const cpuPeriod = 100000
+
+// Command line overrides for the build configuration
+type Flags struct {
+	NoCache bool
+	Squash  bool
+	Pull    string
+	Network string
+	Memory  string
+	CPUs    float64
+}
+
+func (flags Flags) Apply(buildConfig *config.ContainerConfigBuild) {
+	if flags.NoCache {
+		buildConfig.NoCache = true
+	}
+	if flags.Squash {
+		buildConfig.Squash = true
+	}
+	if flags.Pull != "" {
+		buildConfig.Pull = flags.Pull
+	}
+	if flags.Network != "" {
+		buildConfig.Network = flags.Network
+	}
+	if flags.Memory != "" {
+		buildConfig.Limits.Memory = flags.Memory
+	}
+	if flags.CPUs != 0 {
+		buildConfig.Limits.CPUs = flags.CPUs
+	}
+}
+
+func PullPolicy(policy string) (define.PullPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "missing":
+		return define.PullIfMissing, nil
+	case "always":
+		return define.PullAlways, nil
+	case "newer":
+		return define.PullIfNewer, nil
+	case "never":
+		return define.PullNever, nil
+	}
+	return define.PullIfMissing, fmt.Errorf("invalid pull policy %s, expected always, missing, newer or never", policy)
+}
+
+// Configures the network namespace of RUN instructions, none allows hermetic builds
+func NetworkOptions(options *define.BuildOptions, network string) error {
+	switch strings.ToLower(network) {
+	case "":
+		return nil
+	case "none":
+		options.ConfigureNetwork = define.NetworkDisabled
+		options.NamespaceOptions = append(options.NamespaceOptions, define.NamespaceOption{
+			Name: string(specs.NetworkNamespace),
+		})
+	case "private":
+		options.ConfigureNetwork = define.NetworkEnabled
+		options.NamespaceOptions = append(options.NamespaceOptions, define.NamespaceOption{
+			Name: string(specs.NetworkNamespace),
+		})
+	case "host":
+		options.ConfigureNetwork = define.NetworkEnabled
+		options.NamespaceOptions = append(options.NamespaceOptions, define.NamespaceOption{
+			Name: string(specs.NetworkNamespace),
+			Host: true,
+		})
+	default:
+		return fmt.Errorf("invalid build network %s, expected none, private or host", network)
+	}
+	return nil
+}
+
+func LimitOptions(commonBuildOptions *define.CommonBuildOptions, limits config.ContainerConfigBuildLimits) error {
+	var err error
+
+	commonBuildOptions.Ulimit = limits.Ulimit
+	commonBuildOptions.CPUShares = limits.CPUShares
+	commonBuildOptions.CPUSetCPUs = limits.CPUSetCPUs
+
+	if limits.Memory != "" {
+		if commonBuildOptions.Memory, err = units.RAMInBytes(limits.Memory); err != nil {
+			return fmt.Errorf("invalid memory limit %s: %w", limits.Memory, err)
+		}
+	}
+
+	// -1 allows unlimited swap, same as podman
+	if limits.MemorySwap == "-1" {
+		commonBuildOptions.MemorySwap = -1
+	} else if limits.MemorySwap != "" {
+		if commonBuildOptions.MemorySwap, err = units.RAMInBytes(limits.MemorySwap); err != nil {
+			return fmt.Errorf("invalid memory swap limit %s: %w", limits.MemorySwap, err)
+		}
+	}
+
+	if limits.CPUs < 0 {
+		return fmt.Errorf("invalid cpu limit %v", limits.CPUs)
+	} else if limits.CPUs > 0 {
+		commonBuildOptions.CPUPeriod = cpuPeriod
+		commonBuildOptions.CPUQuota = int64(limits.CPUs * cpuPeriod)
+	}
+
+	return nil
+}
+
+func Labels(labels map[string]string) []string {
+	var result []string
+	for k, v := range labels {
+		result = append(result, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,136 @@
+package build
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/julioln/sandman/config"
+
+	"github.com/containers/buildah/define"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestPullPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected define.PullPolicy
+		valid    bool
+	}{
+		{"", define.PullIfMissing, true},
+		{"missing", define.PullIfMissing, true},
+		{"Always", define.PullAlways, true},
+		{"newer", define.PullIfNewer, true},
+		{"never", define.PullNever, true},
+		{"ifnewer", define.PullIfMissing, false},
+		{"sometimes", define.PullIfMissing, false},
+	}
+
+	for _, test := range tests {
+		policy, err := PullPolicy(test.policy)
+		if (err == nil) != test.valid {
+			t.Errorf("policy %q, expected valid %v, got %v", test.policy, test.valid, err)
+		}
+		if policy != test.expected {
+			t.Errorf("policy %q, expected %v, got %v", test.policy, test.expected, policy)
+		}
+	}
+}
+
+func TestNetworkOptions(t *testing.T) {
+	tests := []struct {
+		network    string
+		configure  define.NetworkConfigurationPolicy
+		namespaces []define.NamespaceOption
+		valid      bool
+	}{
+		{"", define.NetworkDefault, nil, true},
+		{"none", define.NetworkDisabled, []define.NamespaceOption{{Name: string(specs.NetworkNamespace)}}, true},
+		{"Private", define.NetworkEnabled, []define.NamespaceOption{{Name: string(specs.NetworkNamespace)}}, true},
+		{"host", define.NetworkEnabled, []define.NamespaceOption{{Name: string(specs.NetworkNamespace), Host: true}}, true},
+		{"slirp4netns", define.NetworkDefault, nil, false},
+		{"bridge", define.NetworkDefault, nil, false},
+	}
+
+	for _, test := range tests {
+		var options define.BuildOptions
+		err := NetworkOptions(&options, test.network)
+		if (err == nil) != test.valid {
+			t.Errorf("network %q, expected valid %v, got %v", test.network, test.valid, err)
+			continue
+		}
+		if options.ConfigureNetwork != test.configure {
+			t.Errorf("network %q, expected %v, got %v", test.network, test.configure, options.ConfigureNetwork)
+		}
+		if !slices.Equal(options.NamespaceOptions, test.namespaces) {
+			t.Errorf("network %q, expected namespaces %v, got %v", test.network, test.namespaces, options.NamespaceOptions)
+		}
+	}
+}
+
+func TestLimitOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   config.ContainerConfigBuildLimits
+		expected define.CommonBuildOptions
+		valid    bool
+	}{
+		{"none", config.ContainerConfigBuildLimits{}, define.CommonBuildOptions{}, true},
+		{"memory", config.ContainerConfigBuildLimits{Memory: "512m", MemorySwap: "1g"}, define.CommonBuildOptions{Memory: 512 << 20, MemorySwap: 1 << 30}, true},
+		{"unlimited swap", config.ContainerConfigBuildLimits{MemorySwap: "-1"}, define.CommonBuildOptions{MemorySwap: -1}, true},
+		{"cpus", config.ContainerConfigBuildLimits{CPUs: 1.5, CPUShares: 512, CPUSetCPUs: "0-3"}, define.CommonBuildOptions{CPUPeriod: cpuPeriod, CPUQuota: 150000, CPUShares: 512, CPUSetCPUs: "0-3"}, true},
+		{"invalid memory", config.ContainerConfigBuildLimits{Memory: "lots"}, define.CommonBuildOptions{}, false},
+		{"negative memory", config.ContainerConfigBuildLimits{Memory: "-512m"}, define.CommonBuildOptions{}, false},
+		{"invalid swap", config.ContainerConfigBuildLimits{MemorySwap: "-2"}, define.CommonBuildOptions{}, false},
+		{"negative cpus", config.ContainerConfigBuildLimits{CPUs: -1}, define.CommonBuildOptions{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var options define.CommonBuildOptions
+			err := LimitOptions(&options, test.limits)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+			if options.Memory != test.expected.Memory || options.MemorySwap != test.expected.MemorySwap {
+				t.Errorf("expected memory %d and swap %d, got %d and %d", test.expected.Memory, test.expected.MemorySwap, options.Memory, options.MemorySwap)
+			}
+			if options.CPUPeriod != test.expected.CPUPeriod || options.CPUQuota != test.expected.CPUQuota {
+				t.Errorf("expected cpu period %d and quota %d, got %d and %d", test.expected.CPUPeriod, test.expected.CPUQuota, options.CPUPeriod, options.CPUQuota)
+			}
+			if options.CPUShares != test.expected.CPUShares || options.CPUSetCPUs != test.expected.CPUSetCPUs {
+				t.Errorf("expected cpu shares %d and set %q, got %d and %q", test.expected.CPUShares, test.expected.CPUSetCPUs, options.CPUShares, options.CPUSetCPUs)
+			}
+		})
+	}
+}
+
+func TestLabels(t *testing.T) {
+	labels := Labels(map[string]string{"version": "1.0", "maintainer": "me", "empty": ""})
+	expected := []string{"empty=", "maintainer=me", "version=1.0"}
+	if !slices.Equal(labels, expected) {
+		t.Errorf("expected %v, got %v", expected, labels)
+	}
+	if labels := Labels(nil); len(labels) != 0 {
+		t.Errorf("expected no labels, got %v", labels)
+	}
+}
+
+func TestFlagsApply(t *testing.T) {
+	buildConfig := config.ContainerConfigBuild{Pull: "never", Network: "host"}
+	buildConfig.Limits.Memory = "1g"
+	buildConfig.Limits.CPUs = 2
+
+	// Unset flags keep the configuration
+	Flags{}.Apply(&buildConfig)
+	if buildConfig.NoCache || buildConfig.Squash || buildConfig.Pull != "never" || buildConfig.Network != "host" || buildConfig.Limits.Memory != "1g" || buildConfig.Limits.CPUs != 2 {
+		t.Errorf("empty flags changed the configuration: %+v", buildConfig)
+	}
+
+	Flags{NoCache: true, Squash: true, Pull: "always", Network: "none", Memory: "512m", CPUs: 0.5}.Apply(&buildConfig)
+	if !buildConfig.NoCache || !buildConfig.Squash || buildConfig.Pull != "always" || buildConfig.Network != "none" || buildConfig.Limits.Memory != "512m" || buildConfig.Limits.CPUs != 0.5 {
+		t.Errorf("flags not applied: %+v", buildConfig)
+	}
+}
@@ -0,0 +1,105 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/julioln/sandman/config"
+)
+
+// Secret ids and sources are joined in buildah's comma separated options
+var secretIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Resolves build secrets into buildah's id=,src= form. Environment secrets are written to private
+// temporary files, which are returned so they can be removed after the build.
+func Secrets(containerConfig config.ContainerConfig) ([]string, []string, error) {
+	var secrets []string
+	var tempFiles []string
+	var ids []string
+
+	for id := range containerConfig.Build.Secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		var secret config.ContainerConfigBuildSecret = containerConfig.Build.Secrets[id]
+		var src string = secret.File
+
+		if !secretIdPattern.MatchString(id) {
+			RemoveFiles(tempFiles)
+			return nil, nil, fmt.Errorf("invalid secret id %q, expected letters, digits, '_', '.' or '-'", id)
+		}
+		if strings.Contains(src, ",") {
+			RemoveFiles(tempFiles)
+			return nil, nil, fmt.Errorf("invalid file %s of secret %s, it can't contain a comma", src, id)
+		}
+
+		if secret.Env != "" {
+			value, exists := os.LookupEnv(secret.Env)
+			if !exists {
+				RemoveFiles(tempFiles)
+				return nil, nil, fmt.Errorf("environment variable %s for secret %s is not set", secret.Env, id)
+			}
+
+			// CreateTemp uses 0600, so only the current user can read it
+			file, err := os.CreateTemp("", "sandman_secret_")
+			if err != nil {
+				RemoveFiles(tempFiles)
+				return nil, nil, err
+			}
+			tempFiles = append(tempFiles, file.Name())
+
+			_, err = file.WriteString(value)
+			file.Close()
+			if err != nil {
+				RemoveFiles(tempFiles)
+				return nil, nil, err
+			}
+			src = file.Name()
+		}
+
+		if src == "" {
+			RemoveFiles(tempFiles)
+			return nil, nil, fmt.Errorf("secret %s needs either File or Env", id)
+		}
+
+		secrets = append(secrets, fmt.Sprintf("id=%s,src=%s", id, src))
+	}
+
+	return secrets, tempFiles, nil
+}
+
+// Resolves cache volumes, relative sources are kept in the sandman build cache directory
+func CacheVolumes(containerConfig config.ContainerConfig) ([]string, error) {
+	var volumes []string
+
+	for _, volume := range containerConfig.Build.CacheVolumes {
+		v := strings.SplitN(volume, ":", 2)
+		if len(v) < 2 || v[0] == "" || v[1] == "" {
+			return nil, fmt.Errorf("invalid cache volume %s, expected source:destination", volume)
+		}
+
+		src := v[0]
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(config.GetBuildCacheDir(), src)
+		}
+		if err := os.MkdirAll(src, 0755); err != nil {
+			return nil, err
+		}
+
+		volumes = append(volumes, fmt.Sprintf("%s:%s", src, v[1]))
+	}
+
+	return volumes, nil
+}
+
+func RemoveFiles(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
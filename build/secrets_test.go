@@ -0,0 +1,102 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/julioln/sandman/config"
+)
+
+func TestSecrets(t *testing.T) {
+	t.Setenv("SANDMAN_TEST_TOKEN", "token")
+	secretFile := fmt.Sprintf("%s/secret", t.TempDir())
+
+	tests := []struct {
+		name    string
+		secrets map[string]config.ContainerConfigBuildSecret
+		valid   bool
+	}{
+		{"file", map[string]config.ContainerConfigBuildSecret{"npm-token_1.0": {File: secretFile}}, true},
+		{"env", map[string]config.ContainerConfigBuildSecret{"token": {Env: "SANDMAN_TEST_TOKEN"}}, true},
+		{"unset env", map[string]config.ContainerConfigBuildSecret{"token": {Env: "SANDMAN_TEST_UNSET"}}, false},
+		{"no source", map[string]config.ContainerConfigBuildSecret{"token": {}}, false},
+		{"id with options", map[string]config.ContainerConfigBuildSecret{"token,src=/etc/shadow": {File: secretFile}}, false},
+		{"id with equals", map[string]config.ContainerConfigBuildSecret{"id=token": {File: secretFile}}, false},
+		{"id with space", map[string]config.ContainerConfigBuildSecret{"my token": {File: secretFile}}, false},
+		{"empty id", map[string]config.ContainerConfigBuildSecret{"": {File: secretFile}}, false},
+		{"file with options", map[string]config.ContainerConfigBuildSecret{"token": {File: secretFile + ",type=env"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig := new(config.ContainerConfig)
+			testConfig.Build.Secrets = test.secrets
+			secrets, files, err := Secrets(*testConfig)
+			defer RemoveFiles(files)
+			if (err == nil) != test.valid {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if test.valid && len(secrets) != 1 {
+				t.Errorf("expected a secret, got %v", secrets)
+			}
+		})
+	}
+
+	// Environment secrets are private files, removed after the build
+	testConfig := new(config.ContainerConfig)
+	testConfig.Build.Secrets = map[string]config.ContainerConfigBuildSecret{"b": {Env: "SANDMAN_TEST_TOKEN"}, "a": {File: secretFile}}
+	secrets, files, err := Secrets(*testConfig)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected a temporary file, got %v (%v)", files, err)
+	}
+	expected := []string{fmt.Sprintf("id=a,src=%s", secretFile), fmt.Sprintf("id=b,src=%s", files[0])}
+	if !slices.Equal(secrets, expected) {
+		t.Errorf("expected %v, got %v", expected, secrets)
+	}
+	if info, err := os.Stat(files[0]); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a private secret file, got %v (%v)", info, err)
+	}
+	if content, _ := os.ReadFile(files[0]); string(content) != "token" {
+		t.Errorf("expected the secret value, got %q", content)
+	}
+	RemoveFiles(files)
+	if _, err := os.Stat(files[0]); err == nil {
+		t.Errorf("secret file not removed")
+	}
+}
+
+func TestCacheVolumes(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	absolute := t.TempDir()
+
+	tests := []struct {
+		volumes  []string
+		expected []string
+		valid    bool
+	}{
+		{[]string{"pacman:/var/cache/pacman/pkg"}, []string{fmt.Sprintf("%s/pacman:/var/cache/pacman/pkg", config.GetBuildCacheDir())}, true},
+		{[]string{absolute + ":/cache:ro"}, []string{absolute + ":/cache:ro"}, true},
+		{[]string{"pacman"}, nil, false},
+		{[]string{":/cache"}, nil, false},
+		{[]string{"pacman:"}, nil, false},
+	}
+
+	for _, test := range tests {
+		testConfig := new(config.ContainerConfig)
+		testConfig.Build.CacheVolumes = test.volumes
+		volumes, err := CacheVolumes(*testConfig)
+		if (err == nil) != test.valid {
+			t.Errorf("volumes %v, expected valid %v, got %v", test.volumes, test.valid, err)
+			continue
+		}
+		if !slices.Equal(volumes, test.expected) {
+			t.Errorf("volumes %v, expected %v, got %v", test.volumes, test.expected, volumes)
+		}
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%s/pacman", config.GetBuildCacheDir())); err != nil {
+		t.Errorf("cache volume source not created: %v", err)
+	}
+}
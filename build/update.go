@@ -0,0 +1,310 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/julioln/sandman/config"
+	"github.com/julioln/sandman/podman"
+
+	"github.com/containers/podman/v6/libpod/define"
+	"github.com/containers/podman/v6/pkg/bindings/containers"
+	"github.com/containers/podman/v6/pkg/bindings/images"
+	"github.com/containers/podman/v6/pkg/specgen"
+	"go.podman.io/common/pkg/auth"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/pkg/shortnames"
+	"go.podman.io/image/v5/types"
+)
+
+const (
+	statusUpToDate   = "up to date"
+	statusNotBuilt   = "not built"
+	statusOutdated   = "base image changed"
+	statusUpdates    = "updates available"
+	statusRebuilt    = "rebuilt"
+	statusFailed     = "failed"
+	statusCheckError = "check failed"
+)
+
+type UpdateResult struct {
+	Name       string
+	BaseImages []string
+	Status     string
+	Rebuild    bool
+	NoCache    bool
+}
+
+// Extracts the external images from the FROM instructions, ignoring scratch and previous stages
+func BaseImages(instructions string) []string {
+	var bases []string
+	var stages = map[string]bool{"scratch": true}
+
+	for _, line := range strings.Split(instructions, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		// Skip flags such as --platform
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		image := fields[0]
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+
+		// Build arguments can't be resolved here
+		if stages[strings.ToLower(image)] || strings.Contains(image, "$") {
+			continue
+		}
+		bases = append(bases, image)
+	}
+
+	return bases
+}
+
+// Registries, short names and credentials as podman uses them, from the user configuration
+func registryContext() *types.SystemContext {
+	return &types.SystemContext{AuthFilePath: auth.GetDefaultAuthFile()}
+}
+
+// The reference the local image was pulled from, short names resolve through registries.conf
+func baseImageReference(sys *types.SystemContext, image string, repoTags []string) (reference.Named, error) {
+	resolved, err := shortnames.Resolve(sys, image)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolved.PullCandidates) == 0 {
+		return nil, fmt.Errorf("no registry to look up %s", image)
+	}
+
+	for _, candidate := range resolved.PullCandidates {
+		if slices.Contains(repoTags, candidate.Value.String()) {
+			return candidate.Value, nil
+		}
+	}
+	return resolved.PullCandidates[0].Value, nil
+}
+
+func baseImageChanged(conn context.Context, image string) (bool, error) {
+	report, err := images.GetImage(conn, image, nil)
+	if err != nil {
+		return false, fmt.Errorf("base image %s is not present locally, pull it to compare: %w", image, err)
+	}
+
+	sys := registryContext()
+	named, err := baseImageReference(sys, image, report.RepoTags)
+	if err != nil {
+		return false, err
+	}
+	ref, err := docker.NewReference(named)
+	if err != nil {
+		return false, err
+	}
+
+	remoteDigest, err := docker.GetDigest(conn, sys, ref)
+	if err != nil {
+		return false, err
+	}
+
+	for _, repoDigest := range report.RepoDigests {
+		if strings.HasSuffix(repoDigest, fmt.Sprintf("@%s", remoteDigest)) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Runs the update check command in an ephemeral container, updates are available if it succeeds with output
+func updatesAvailable(conn context.Context, containerConfig config.ContainerConfig, verbose bool) (bool, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	spec := specgen.NewSpecGenerator(containerConfig.ImageName, false)
+	spec.Entrypoint = []string{"/bin/sh", "-c", containerConfig.Build.UpdateCheck}
+	spec.Labels = map[string]string{
+		"sandman_container_name": containerConfig.Name,
+		"sandman_image_name":     containerConfig.ImageName,
+	}
+
+	var createOptions containers.CreateOptions
+	container, err := containers.CreateWithSpec(conn, spec, &createOptions)
+	if err != nil {
+		return false, err
+	}
+	defer containers.Remove(conn, container.ID, new(containers.RemoveOptions).WithForce(true))
+
+	attachReady := make(chan bool)
+	attachErr := make(chan error)
+	go func() {
+		attachErr <- containers.Attach(conn, container.ID, nil, &stdout, &stderr, attachReady, new(containers.AttachOptions))
+	}()
+
+	select {
+	case <-attachReady:
+	case err := <-attachErr:
+		return false, err
+	}
+
+	if err := containers.Start(conn, container.ID, nil); err != nil {
+		return false, err
+	}
+
+	if err := <-attachErr; err != nil {
+		return false, err
+	}
+
+	var waitOptions containers.WaitOptions
+	waitOptions.Condition = append(waitOptions.Condition, define.ContainerStateExited, define.ContainerStateStopped)
+	exitCode, err := containers.Wait(conn, container.ID, &waitOptions)
+	if err != nil {
+		return false, err
+	}
+
+	if verbose {
+		fmt.Printf("Update check for %s exited with %d\n", containerConfig.Name, exitCode)
+		fmt.Print(stdout.String())
+		fmt.Print(stderr.String())
+	}
+
+	return exitCode == 0 && strings.TrimSpace(stdout.String()) != "", nil
+}
+
+func builtContainerNames(conn context.Context) (map[string]bool, error) {
+	var names = make(map[string]bool)
+	var listOptions = new(images.ListOptions).WithFilters(map[string][]string{
+		"label": {"sandman_container_name"},
+	})
+
+	summaries, err := images.List(conn, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, summary := range summaries {
+		names[summary.Labels["sandman_container_name"]] = true
+	}
+
+	return names, nil
+}
+
+func Check(conn context.Context, containerConfig config.ContainerConfig, built map[string]bool, verbose bool) UpdateResult {
+	var result = UpdateResult{
+		Name:       containerConfig.Name,
+		BaseImages: BaseImages(containerConfig.Build.Instructions),
+		Status:     statusUpToDate,
+	}
+
+	if !built[containerConfig.Name] {
+		result.Status = statusNotBuilt
+		return result
+	}
+
+	for _, base := range result.BaseImages {
+		changed, err := baseImageChanged(conn, base)
+		if err != nil {
+			fmt.Printf("Failed to check base image %s of %s\n", base, containerConfig.Name)
+			fmt.Println("Error: ", err)
+			result.Status = statusCheckError
+			return result
+		}
+		if changed {
+			result.Status = statusOutdated
+			result.Rebuild = true
+			return result
+		}
+	}
+
+	if containerConfig.Build.UpdateCheck != "" {
+		available, err := updatesAvailable(conn, containerConfig, verbose)
+		if err != nil {
+			fmt.Printf("Failed to run update check of %s\n", containerConfig.Name)
+			fmt.Println("Error: ", err)
+			result.Status = statusCheckError
+			return result
+		}
+		if available {
+			result.Status = statusUpdates
+			result.Rebuild = true
+			result.NoCache = true
+		}
+	}
+
+	return result
+}
+
+func rebuild(socket string, conn context.Context, containerConfig config.ContainerConfig, result UpdateResult, layers bool, verbose bool) error {
+	for _, base := range result.BaseImages {
+		if _, err := images.Pull(conn, base, new(images.PullOptions)); err != nil {
+			return err
+		}
+	}
+
+	if result.NoCache {
+		containerConfig.Build.NoCache = true
+	}
+
+	if err := Build(socket, containerConfig, layers, verbose); err != nil {
+		return fmt.Errorf("build failed: %w", err)
+	}
+
+	return nil
+}
+
+func Update(socket string, names []string, layers bool, dryRun bool, verbose bool) {
+	var conn context.Context = podman.InitializePodman(socket)
+	var results []UpdateResult
+
+	built, err := builtContainerNames(conn)
+	if err != nil {
+		fmt.Println("Failed to list sandman images")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+
+	for _, name := range names {
+		var containerConfig config.ContainerConfig = config.LoadConfig(name)
+		result := Check(conn, containerConfig, built, verbose)
+
+		if result.Rebuild && !dryRun {
+			fmt.Printf("Rebuilding %s: %s\n", name, result.Status)
+			if err := rebuild(socket, conn, containerConfig, result, layers, verbose); err != nil {
+				fmt.Println("Error: ", err)
+				result.Status = statusFailed
+			} else {
+				result.Status = statusRebuilt
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBASE IMAGES\tSTATUS")
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Name, strings.Join(result.BaseImages, ","), result.Status)
+	}
+	w.Flush()
+}
+
+func CmdExecuteUpdate(socket string, verbose bool, layers bool, dryRun bool, args []string) {
+	var names []string = args
+	if len(names) == 0 {
+		names = config.ListContainerNames()
+	}
+	Update(socket, names, layers, dryRun, verbose)
+}
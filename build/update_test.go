@@ -0,0 +1,32 @@
+package build
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBaseImages(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions string
+		expected     []string
+	}{
+		{"single", "FROM fedora:43\nRUN dnf -y install xclock", []string{"fedora:43"}},
+		{"lowercase", "from docker.io/library/alpine\n", []string{"docker.io/library/alpine"}},
+		{"platform", "FROM --platform=linux/amd64 debian:trixie", []string{"debian:trixie"}},
+		{"scratch", "FROM scratch\nCOPY app /", nil},
+		{"stages", "FROM golang:1.25 AS builder\nRUN go build\nFROM Builder\nFROM alpine\nCOPY --from=builder /app /", []string{"golang:1.25", "alpine"}},
+		{"build argument", "ARG BASE=fedora\nFROM $BASE\nFROM ${BASE}:43", nil},
+		{"incomplete", "FROM\nFROM --platform=linux/amd64\n", nil},
+		{"not an instruction", "RUN echo FROM fedora\n# FROM ubuntu", nil},
+		{"empty", "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if bases := BaseImages(test.instructions); !slices.Equal(bases, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, bases)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/julioln/sandman/config"
+	"github.com/julioln/sandman/constants"
+	"github.com/julioln/sandman/podman"
+
+	"github.com/containers/podman/v6/pkg/bindings/images"
+	"github.com/docker/go-units"
+)
+
+type Version struct {
+	Tag     string
+	ID      string
+	Created time.Time
+	Size    int64
+}
+
+func VersionReference(imageName string, tag string) string {
+	return fmt.Sprintf("%s:%s", imageName, tag)
+}
+
+// A timestamp, with a counter suffix when the image already has a build of the same second
+func NewVersionTag(conn context.Context, imageName string) (string, error) {
+	var timestamp string = time.Now().Format(constants.BUILD_TAG_FORMAT)
+	var tag string = timestamp
+	for count := 1; ; count++ {
+		exists, err := images.Exists(conn, VersionReference(imageName, tag), nil)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return tag, nil
+		}
+		tag = fmt.Sprintf("%s-%d", timestamp, count)
+	}
+}
+
+// Splits a version tag in its timestamp and counter
+func parseVersionTag(tag string) (time.Time, int, bool) {
+	timestamp, suffix, found := strings.Cut(tag, "-")
+	created, err := time.Parse(constants.BUILD_TAG_FORMAT, timestamp)
+	if err != nil {
+		return created, 0, false
+	}
+	if !found {
+		return created, 0, true
+	}
+	count, err := strconv.Atoi(suffix)
+	if err != nil || count < 1 || strconv.Itoa(count) != suffix {
+		return created, 0, false
+	}
+	return created, count, true
+}
+
+func isVersionTag(tag string) bool {
+	_, _, valid := parseVersionTag(tag)
+	return valid
+}
+
+// Newest first, builds of the same second by their counter
+func sortVersions(versions []Version) {
+	sort.Slice(versions, func(i, j int) bool {
+		iCreated, iCount, _ := parseVersionTag(versions[i].Tag)
+		jCreated, jCount, _ := parseVersionTag(versions[j].Tag)
+		if !iCreated.Equal(jCreated) {
+			return iCreated.After(jCreated)
+		}
+		return iCount > jCount
+	})
+}
+
+func splitRepoTag(repoTag string) (string, string) {
+	i := strings.LastIndex(repoTag, ":")
+	if i < 0 || strings.Contains(repoTag[i:], "/") {
+		return repoTag, ""
+	}
+	// Podman prefixes unqualified names with localhost
+	return strings.TrimPrefix(repoTag[:i], "localhost/"), repoTag[i+1:]
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Lists the timestamped builds of an image, newest first
+func Versions(conn context.Context, imageName string) ([]Version, error) {
+	var versions []Version
+	var listOptions = new(images.ListOptions).WithFilters(map[string][]string{
+		"label": {fmt.Sprintf("sandman_image_name=%s", imageName)},
+	})
+
+	summaries, err := images.List(conn, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, summary := range summaries {
+		for _, repoTag := range summary.RepoTags {
+			repo, tag := splitRepoTag(repoTag)
+			if repo != imageName || !isVersionTag(tag) {
+				continue
+			}
+			versions = append(versions, Version{
+				Tag:     tag,
+				ID:      summary.ID,
+				Created: time.Unix(summary.Created, 0),
+				Size:    summary.Size,
+			})
+		}
+	}
+
+	sortVersions(versions)
+
+	return versions, nil
+}
+
+func LatestID(conn context.Context, imageName string) (string, error) {
+	report, err := images.GetImage(conn, VersionReference(imageName, constants.LATEST_TAG), nil)
+	if err != nil {
+		return "", err
+	}
+	return report.ID, nil
+}
+
+// Removes the timestamped tags beyond the retention count, images still tagged elsewhere are kept
+func Prune(conn context.Context, imageName string, retention int, verbose bool) {
+	if retention <= 0 {
+		return
+	}
+
+	versions, err := Versions(conn, imageName)
+	if err != nil {
+		fmt.Println("Failed to list image versions, skipping pruning")
+		fmt.Println("Error: ", err)
+		return
+	}
+
+	if len(versions) <= retention {
+		return
+	}
+
+	var refs []string
+	for _, version := range versions[retention:] {
+		refs = append(refs, VersionReference(imageName, version.Tag))
+	}
+
+	if verbose {
+		fmt.Println("Pruning image versions: ", refs)
+	}
+
+	if _, errs := images.Remove(conn, refs, nil); len(errs) > 0 {
+		fmt.Println("Failed to prune image versions")
+		for _, err := range errs {
+			fmt.Println("Error: ", err)
+		}
+	}
+}
+
+func previousVersion(versions []Version, latestID string) (string, error) {
+	for i, version := range versions {
+		if version.ID != latestID {
+			continue
+		}
+		// Tags of the same image are the same build
+		for _, previous := range versions[i+1:] {
+			if previous.ID != latestID {
+				return previous.Tag, nil
+			}
+		}
+		return "", errors.New("latest is already the oldest build")
+	}
+	return "", errors.New("latest does not match any build, specify a tag")
+}
+
+func List(socket string, containerConfig config.ContainerConfig, verbose bool) {
+	var conn context.Context = podman.InitializePodman(socket)
+
+	versions, err := Versions(conn, containerConfig.ImageName)
+	if err != nil {
+		fmt.Println("Failed to list image versions")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+
+	latestID, err := LatestID(conn, containerConfig.ImageName)
+	if err != nil && verbose {
+		fmt.Println("Failed to inspect latest image: ", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "TAG\tIMAGE ID\tCREATED\tSIZE\tLATEST")
+	for _, version := range versions {
+		var latest string
+		if version.ID == latestID {
+			latest = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			version.Tag,
+			shortID(version.ID),
+			version.Created.Format(time.DateTime),
+			units.HumanSize(float64(version.Size)),
+			latest,
+		)
+	}
+	w.Flush()
+}
+
+func Rollback(socket string, containerConfig config.ContainerConfig, tag string, verbose bool) {
+	var conn context.Context = podman.InitializePodman(socket)
+
+	versions, err := Versions(conn, containerConfig.ImageName)
+	if err != nil {
+		fmt.Println("Failed to list image versions")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+
+	if tag == "" {
+		latestID, err := LatestID(conn, containerConfig.ImageName)
+		if err != nil {
+			fmt.Println("Failed to inspect latest image")
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+
+		if tag, err = previousVersion(versions, latestID); err != nil {
+			fmt.Println("Can't find a previous build to roll back to")
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+	} else {
+		found := false
+		for _, version := range versions {
+			if version.Tag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fmt.Printf("No build tagged %s for %s\n", tag, containerConfig.ImageName)
+			os.Exit(1)
+		}
+	}
+
+	if verbose {
+		fmt.Printf("Tagging %s as %s\n", VersionReference(containerConfig.ImageName, tag), constants.LATEST_TAG)
+	}
+
+	if err := images.Tag(conn, VersionReference(containerConfig.ImageName, tag), constants.LATEST_TAG, containerConfig.ImageName, nil); err != nil {
+		fmt.Println("Failed to tag image")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Rolled back %s to %s\n", containerConfig.ImageName, tag)
+}
+
+func CmdExecuteImages(socket string, verbose bool, args []string) {
+	var container_name string = args[0]
+	List(socket, config.LoadConfig(container_name), verbose)
+}
+
+func CmdExecuteRollback(socket string, verbose bool, args []string) {
+	var container_name string = args[0]
+	var tag string
+	if len(args) > 1 {
+		tag = args[1]
+	}
+	Rollback(socket, config.LoadConfig(container_name), tag, verbose)
+}
@@ -0,0 +1,83 @@
+package build
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestVersionTag(t *testing.T) {
+	tests := []struct {
+		tag   string
+		valid bool
+	}{
+		{"20240101120000", true},
+		{"20240101120000-1", true},
+		{"20240101120000-12", true},
+		{"20240101120000-0", false},
+		{"20240101120000-01", false},
+		{"20240101120000-", false},
+		{"20240101120000-a", false},
+		{"latest", false},
+		{"2024010112", false},
+	}
+
+	for _, test := range tests {
+		if valid := isVersionTag(test.tag); valid != test.valid {
+			t.Errorf("tag %s, expected valid %v, got %v", test.tag, test.valid, valid)
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []Version{
+		{Tag: "20240101120000"},
+		{Tag: "20240101120000-10"},
+		{Tag: "20240102080000"},
+		{Tag: "20240101120000-9"},
+		{Tag: "20231231235959"},
+	}
+	sortVersions(versions)
+
+	var tags []string
+	for _, version := range versions {
+		tags = append(tags, version.Tag)
+	}
+	expected := []string{"20240102080000", "20240101120000-10", "20240101120000-9", "20240101120000", "20231231235959"}
+	if !slices.Equal(tags, expected) {
+		t.Errorf("expected %v, got %v", expected, tags)
+	}
+}
+
+func TestPreviousVersion(t *testing.T) {
+	versions := []Version{
+		{Tag: "20240103120000", ID: "c"},
+		{Tag: "20240102120000-1", ID: "b"},
+		{Tag: "20240102120000", ID: "b"},
+		{Tag: "20240101120000", ID: "a"},
+	}
+
+	tests := []struct {
+		latestID string
+		expected string
+		fails    bool
+	}{
+		{"c", "20240102120000-1", false},
+		// A rebuild without changes is the same image
+		{"b", "20240101120000", false},
+		{"a", "", true},
+		{"unknown", "", true},
+	}
+
+	for _, test := range tests {
+		tag, err := previousVersion(versions, test.latestID)
+		if test.fails {
+			if err == nil {
+				t.Errorf("latest %s, expected an error, got %s", test.latestID, tag)
+			}
+			continue
+		}
+		if err != nil || tag != test.expected {
+			t.Errorf("latest %s, expected %s, got %s (%v)", test.latestID, test.expected, tag, err)
+		}
+	}
+}
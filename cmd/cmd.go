@@ -17,6 +17,10 @@ var (
 	Keep    bool   = false
 	Layers  bool   = false
 	Socket  string = ""
+	Tag     string = ""
+	DryRun  bool   = false
+
+	BuildFlags build.Flags
 
 	rootCmd = &cobra.Command{
 		Use:     "sandman",
@@ -37,7 +41,7 @@ var (
 		Aliases: []string{"b"},
 		Args:    cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			build.CmdExecute(Socket, Verbose, Layers, args)
+			build.CmdExecute(Socket, Verbose, Layers, BuildFlags, args)
 		},
 	}
 
@@ -48,7 +52,7 @@ var (
 		Aliases: []string{"r"},
 		Args:    cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			run.CmdExecuteRun(Socket, Verbose, Keep, args)
+			run.CmdExecuteRun(Socket, Verbose, Keep, Tag, args)
 		},
 	}
 
@@ -59,7 +63,79 @@ var (
 		Aliases: []string{"s"},
 		Args:    cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			run.CmdExecuteStart(Socket, Verbose, Keep, args)
+			run.CmdExecuteStart(Socket, Verbose, Keep, Tag, args)
+		},
+	}
+
+	updateCmd = &cobra.Command{
+		Use:     "update [container_name...]",
+		Short:   "Rebuilds images whose base image or packages changed",
+		Long:    "Rebuilds images whose base image or packages changed. Defaults to all configured containers",
+		Aliases: []string{"u"},
+		Run: func(cmd *cobra.Command, args []string) {
+			build.CmdExecuteUpdate(Socket, Verbose, Layers, DryRun, args)
+		},
+	}
+
+	imagesCmd = &cobra.Command{
+		Use:   "images [container_name]",
+		Short: "Lists past builds of an image",
+		Long:  "Lists past builds of an image",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			build.CmdExecuteImages(Socket, Verbose, args)
+		},
+	}
+
+	rollbackCmd = &cobra.Command{
+		Use:   "rollback [container_name] [tag]",
+		Short: "Tags a past build as latest",
+		Long:  "Tags a past build as latest. Defaults to the build before the current latest",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			build.CmdExecuteRollback(Socket, Verbose, args)
+		},
+	}
+
+	identityCmd = &cobra.Command{
+		Use:   "identity",
+		Short: "Manage the generated identity of sandboxes",
+		Long:  "Manage the generated machine-id, hostname and username of sandboxes",
+	}
+
+	identityResetCmd = &cobra.Command{
+		Use:   "reset [container_name]",
+		Short: "Rotate the identity of a sandbox",
+		Long:  "Remove the generated identity of a sandbox, a new one is generated on the next run",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			run.CmdExecuteIdentityReset(Verbose, args)
+		},
+	}
+
+	usbCmd = &cobra.Command{
+		Use:   "usb",
+		Short: "Inspect usb devices",
+		Long:  "Inspect usb devices",
+	}
+
+	usbListCmd = &cobra.Command{
+		Use:   "list [selector...]",
+		Short: "Lists usb devices matching the selectors",
+		Long:  "Lists usb devices matching any of the selectors (same syntax as UsbDevices), or all of them",
+		Run: func(cmd *cobra.Command, args []string) {
+			run.CmdExecuteUsbList(Verbose, args)
+		},
+	}
+
+	// Run by sandman itself, in the network namespace of a sandbox
+	netnsListenCmd = &cobra.Command{
+		Use:    run.NetnsListenCommand + " [network:address...]",
+		Short:  "Listens in the current network namespace and hands the sockets to sandman",
+		Hidden: true,
+		Args:   cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			run.CmdExecuteNetnsListen(args)
 		},
 	}
 
@@ -104,11 +180,29 @@ func init() {
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(testCmd)
 	rootCmd.AddCommand(setupCmd)
+	rootCmd.AddCommand(imagesCmd)
+	rootCmd.AddCommand(rollbackCmd)
+	rootCmd.AddCommand(updateCmd)
+	rootCmd.AddCommand(identityCmd)
+	identityCmd.AddCommand(identityResetCmd)
+	rootCmd.AddCommand(usbCmd)
+	usbCmd.AddCommand(usbListCmd)
+	rootCmd.AddCommand(netnsListenCmd)
 
 	rootCmd.PersistentFlags().BoolVarP(&Verbose, "verbose", "v", false, "Verbose mode (log debug). Defaults to false")
 	rootCmd.PersistentFlags().StringVarP(&Socket, "socket", "", "", fmt.Sprintf("Specify podman socket. Defaults to %s", podman.DefaultSocket()))
 
 	buildCmd.Flags().BoolVarP(&Layers, "layers", "l", false, "Use layers for building (default docker behavior)")
+	buildCmd.Flags().BoolVarP(&BuildFlags.NoCache, "no-cache", "", false, "Do not use cached layers")
+	buildCmd.Flags().BoolVarP(&BuildFlags.Squash, "squash", "", false, "Squash the new layers into a single one")
+	buildCmd.Flags().StringVarP(&BuildFlags.Pull, "pull", "", "", "Pull policy for the base image: always, missing, newer or never")
+	buildCmd.Flags().StringVarP(&BuildFlags.Network, "network", "", "", "Network for RUN instructions: none, private or host")
+	buildCmd.Flags().StringVarP(&BuildFlags.Memory, "memory", "m", "", "Memory limit for the build (e.g. 4g)")
+	buildCmd.Flags().Float64VarP(&BuildFlags.CPUs, "cpus", "", 0, "Number of CPUs available to the build")
+	updateCmd.Flags().BoolVarP(&Layers, "layers", "l", false, "Use layers for building (default docker behavior)")
+	updateCmd.Flags().BoolVarP(&DryRun, "dry-run", "n", false, "Only report which images would be rebuilt")
 	runCmd.Flags().BoolVarP(&Keep, "keep", "k", false, "Keep container after exit (omit --rm)")
+	runCmd.Flags().StringVarP(&Tag, "tag", "t", "", "Run a specific build of the image instead of latest")
 	startCmd.Flags().BoolVarP(&Keep, "keep", "k", false, "Keep container after exit (omit --rm)")
+	startCmd.Flags().StringVarP(&Tag, "tag", "t", "", "Run a specific build of the image instead of latest")
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"strings"
 
 	"github.com/julioln/sandman/constants"
 
@@ -20,40 +21,137 @@ type ContainerConfigBuild struct {
 	ContextDirectory     string
 	Compression          archive.Compression
 	AdditionalImageNames []string
+	Retention            int
+	UpdateCheck          string
+	Secrets              map[string]ContainerConfigBuildSecret
+	CacheVolumes         []string
+	Network              string
+	Pull                 string
+	NoCache              bool
+	Squash               bool
+	Labels               map[string]string
+	Files                map[string]ContainerConfigBuildFile
 	Limits               ContainerConfigBuildLimits
 }
 
+type ContainerConfigBuildFile struct {
+	Content string
+	Mode    string
+}
+
+type ContainerConfigBuildSecret struct {
+	File string
+	Env  string
+}
+
 type ContainerConfigBuildLimits struct {
-	Ulimit []string
+	Ulimit     []string
+	Memory     string
+	MemorySwap string
+	CPUs       float64
+	CPUShares  uint64
+	CPUSetCPUs string
 }
 
 type ContainerConfigRun struct {
-	X11          bool
-	Wayland      bool
-	Dri          bool
-	Ipc          bool
-	Gpu          bool
-	Pulseaudio   bool
-	Pipewire     bool
-	Dbus         bool
-	Net          bool
-	Uidmap       bool
-	Home         bool
-	HomePath     string
-	Fonts        bool
-	Network      string
-	Name         string
-	CgroupParent string
-	Volumes      []string
-	Env          []string
-	Devices      []string
-	Ports        []string
-	UsbDevices   []string
-	RawMounts    []specs.Mount
-	RawPorts     []nettypes.PortMapping
-	RawDevices   []specs.LinuxDevice
-	Limits       ContainerConfigRunLimits
-	Permissions  ContainerConfigRunPermissions
+	X11                    bool
+	X11Trusted             bool
+	Wayland                bool
+	WaylandSecurityContext bool
+	Dri                    bool
+	Ipc                    bool
+	Gpu                    GpuMode
+	GpuPci                 string
+	Pulseaudio             bool
+	Pipewire               bool
+	Audio                  string
+	AudioPlaybackOnly      bool
+	Dbus                   bool
+	DbusFilter             bool
+	DbusSystem             bool
+	DbusTalk               []string
+	DbusOwn                []string
+	DbusSee                []string
+	Accessibility          bool
+	Notifications          bool
+	Portals                bool
+	SshAgent               bool
+	SshAgentKeys           []string
+	GpgAgent               bool
+	OpenOnHost             bool
+	OpenOnHostSchemes      []string
+	OpenOnHostPrompt       bool
+	Clipboard              string
+	ClipboardMaxSize       int
+	ClipboardLog           bool
+	Net                    bool
+	Uidmap                 bool
+	Home                   bool
+	HomePath               string
+	Fonts                  bool
+	Theme                  bool
+	Locale                 bool
+	Timezone               bool
+	Network                string
+	Networks               []ContainerConfigRunNetwork
+	Dns                    []string
+	DnsSearch              []string
+	ExtraHosts             []string
+	StaticIP               string
+	Hostname               string
+	Egress                 []string
+	HostServices           []string
+	Name                   string
+	GenerateIdentity       bool
+	Identity               string
+	IdentityUser           bool
+	ImageTag               string
+	CgroupParent           string
+	Volumes                []string
+	Env                    []string
+	Devices                []string
+	DeviceCgroupRules      []string
+	MissingDevices         string
+	Ports                  []string
+	UsbDevices             []string
+	UsbHotplug             bool
+	Camera                 bool
+	Gamepad                bool
+	GamepadUinput          bool
+	Printing               bool
+	Scanning               bool
+	ScannerDevices         []string
+	RawMounts              []specs.Mount
+	RawPorts               []nettypes.PortMapping
+	RawDevices             []specs.LinuxDevice
+	Limits                 ContainerConfigRunLimits
+	Permissions            ContainerConfigRunPermissions
+}
+
+// GPU mode, also accepts the legacy boolean
+type GpuMode string
+
+func (g *GpuMode) UnmarshalTOML(data any) error {
+	switch v := data.(type) {
+	case bool:
+		if v {
+			*g = "full"
+		} else {
+			*g = ""
+		}
+	case string:
+		*g = GpuMode(v)
+	default:
+		return fmt.Errorf("invalid Gpu %v, expected a mode or a boolean", data)
+	}
+	return nil
+}
+
+// A network sandman creates when missing
+type ContainerConfigRunNetwork struct {
+	Name     string
+	Subnet   string
+	Internal bool
 }
 
 type ContainerConfigRunPermissions struct {
@@ -106,6 +204,25 @@ func GetHomeStorageDir() string {
 	return fmt.Sprintf("%s/%s", getHomeDir(), constants.SANDMAN_LOCAL_STORAGE)
 }
 
+func GetRuntimeDir() string {
+	if runtimeDir, exists := os.LookupEnv("XDG_RUNTIME_DIR"); exists {
+		return runtimeDir
+	}
+	return fmt.Sprintf("/run/user/%d", os.Getuid())
+}
+
+func GetSandboxRuntimeDir(container_name string) string {
+	return fmt.Sprintf("%s/%s/%s", GetRuntimeDir(), constants.SANDMAN_RUNTIME_DIR, container_name)
+}
+
+func GetIdentityDir(container_name string) string {
+	return fmt.Sprintf("%s/%s/%s", getHomeDir(), constants.SANDMAN_IDENTITY_DIR, container_name)
+}
+
+func GetBuildCacheDir() string {
+	return fmt.Sprintf("%s/%s", getHomeDir(), constants.SANDMAN_BUILD_CACHE)
+}
+
 func GetOldSandmanConfigDir() string {
 	return fmt.Sprintf("%s/%s", getHomeDir(), constants.OLD_SANDMAN_DIR)
 }
@@ -234,6 +351,26 @@ func LoadContainerConfig(container_name string) ContainerConfig {
 	return config
 }
 
+func ListContainerNames() []string {
+	var names []string
+
+	entries, err := os.ReadDir(GetSandmanConfigDir())
+	if err != nil {
+		fmt.Printf("Can't read container configuration directory at %s", GetSandmanConfigDir())
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".toml") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(entry.Name(), ".toml"))
+	}
+
+	return names
+}
+
 func LoadConfig(container_name string) ContainerConfig {
 	var sandmanConfig SandmanConfig = LoadSandmanConfig()
 	var containerConfig ContainerConfig = LoadContainerConfig(container_name)
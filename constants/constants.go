@@ -5,5 +5,10 @@ const (
 	SANDMAN_DIR           = ".config/sandman.d"
 	SANDMAN_CONF          = ".config/sandman.toml"
 	SANDMAN_LOCAL_STORAGE = ".local/share/sandman"
+	SANDMAN_BUILD_CACHE   = ".local/share/sandman/.build-cache"
+	SANDMAN_IDENTITY_DIR  = ".local/share/sandman/.identity"
+	SANDMAN_RUNTIME_DIR   = "sandman"
 	VERSION               = "2.4"
+	BUILD_TAG_FORMAT      = "20060102150405"
+	LATEST_TAG            = "latest"
 )
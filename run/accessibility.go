@@ -0,0 +1,68 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const accessibilityBusName = "org.a11y.Bus"
+
+func accessibilityBusAddress() string {
+	if address, exists := os.LookupEnv("AT_SPI_BUS_ADDRESS"); exists {
+		return address
+	}
+
+	// at-spi2 names the socket after the X11 display (bus_0), or just bus without one
+	var dir string = fmt.Sprintf("%s/at-spi", os.Getenv("XDG_RUNTIME_DIR"))
+	var path string = fmt.Sprintf("%s/bus", dir)
+	matches, _ := filepath.Glob(fmt.Sprintf("%s/bus*", dir))
+	if len(matches) > 0 {
+		path = matches[0]
+	}
+	if number, local := X11DisplayNumber(os.Getenv("DISPLAY")); local && slices.Contains(matches, fmt.Sprintf("%s/bus_%s", dir, number)) {
+		path = fmt.Sprintf("%s/bus_%s", dir, number)
+	}
+	return fmt.Sprintf("unix:path=%s", path)
+}
+
+// Returns the socket path of a unix:path= D-Bus address
+func dbusAddressPath(address string) (string, bool) {
+	path, found := strings.CutPrefix(address, "unix:path=")
+	if !found {
+		return "", false
+	}
+	path, _, _ = strings.Cut(path, ",")
+	return path, true
+}
+
+func Accessibility(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	// AT-SPI uses its own bus, applications skip the session bus lookup when the address is set
+	if containerConfig.Run.Accessibility {
+		var address string = accessibilityBusAddress()
+
+		// Abstract sockets belong to the host network namespace
+		path, found := dbusAddressPath(address)
+		if !found {
+			fmt.Println("Ignoring accessibility, the bus address is not a socket path: ", address)
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			fmt.Println("Ignoring accessibility, the bus is not running: ", err)
+			return
+		}
+
+		spec.Env["AT_SPI_BUS_ADDRESS"] = address
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: filepath.Dir(path),
+			Source:      filepath.Dir(path),
+			Type:        "bind",
+		})
+	}
+}
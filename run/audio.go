@@ -0,0 +1,83 @@
+package run
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/julioln/sandman/config"
+)
+
+const (
+	AudioPipewire      = "pipewire"
+	AudioPulse         = "pulse"
+	AudioPipewirePulse = "pipewire-pulse"
+	AudioNone          = "none"
+)
+
+// Audio mode, derived from the legacy Pulseaudio and Pipewire toggles when not set
+func AudioMode(containerConfig config.ContainerConfig) string {
+	if containerConfig.Run.Audio != "" {
+		return containerConfig.Run.Audio
+	}
+	if containerConfig.Run.Pulseaudio && containerConfig.Run.Pipewire {
+		return AudioPipewirePulse
+	} else if containerConfig.Run.Pulseaudio {
+		return AudioPulse
+	} else if containerConfig.Run.Pipewire {
+		return AudioPipewire
+	}
+	return AudioNone
+}
+
+func audioEnabled(containerConfig config.ContainerConfig) bool {
+	switch AudioMode(containerConfig) {
+	case AudioPipewire, AudioPulse, AudioPipewirePulse:
+		return true
+	}
+	return false
+}
+
+// The native PipeWire protocol can't be filtered, playback only sandboxes go through the PulseAudio proxy
+func audioPipewire(containerConfig config.ContainerConfig) bool {
+	var mode string = AudioMode(containerConfig)
+	return (mode == AudioPipewire || mode == AudioPipewirePulse) && !containerConfig.Run.AudioPlaybackOnly
+}
+
+func audioPulse(containerConfig config.ContainerConfig) bool {
+	var mode string = AudioMode(containerConfig)
+	return mode == AudioPulse || mode == AudioPipewirePulse || (mode == AudioPipewire && containerConfig.Run.AudioPlaybackOnly)
+}
+
+func PrepareAudio(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	switch AudioMode(containerConfig) {
+	case AudioNone:
+		return nil, nil
+	case AudioPipewire, AudioPulse, AudioPipewirePulse:
+	default:
+		return nil, fmt.Errorf("invalid audio mode %s, expected pipewire, pulse, pipewire-pulse or none", containerConfig.Run.Audio)
+	}
+
+	if !containerConfig.Run.AudioPlaybackOnly {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+
+	// Without shared memory all audio goes through the socket, where the proxy can filter it
+	if err := os.WriteFile(PulseClientConfigPath(containerConfig), []byte("enable-shm = no\nenable-memfd = no\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	stop, err := StartPulseProxy(pulseSocketPath(), PulseProxyPath(containerConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if verbose {
+		fmt.Println("PulseAudio playback only proxy: ", PulseProxyPath(containerConfig))
+	}
+
+	return stop, nil
+}
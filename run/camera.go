@@ -0,0 +1,40 @@
+package run
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/citilinkru/libudev/matcher"
+	"github.com/citilinkru/libudev/types"
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Video capture nodes, along with the media controller nodes of the same devices
+func CameraPaths(devices []*types.Device) []string {
+	cameras := matchDevices(devices,
+		matcher.NewRuleEnv("SUBSYSTEM", "^video4linux$"),
+		matcher.NewRuleEnv("ID_V4L_CAPABILITIES", ":capture:"),
+	)
+
+	paths := append(devicePaths(cameras), devicePaths(siblingDevices(devices, cameras, "media"))...)
+	slices.Sort(paths)
+	return paths
+}
+
+func Camera(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.Camera {
+		devices, err := scanDevices()
+		if err != nil {
+			fmt.Println("Failed to list cameras, ignoring.")
+			return
+		}
+
+		for _, path := range CameraPaths(devices) {
+			spec.Devices = append(spec.Devices, specs.LinuxDevice{
+				Path: path,
+			})
+		}
+	}
+}
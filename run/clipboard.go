@@ -0,0 +1,315 @@
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	ClipboardNone  = "none"
+	ClipboardRead  = "read"
+	ClipboardWrite = "write"
+	ClipboardBoth  = "both"
+
+	clipboardSocketDestination = "/tmp/.sandman-clipboard"
+	clipboardCopyDestination   = "/usr/local/bin/clipboard-copy"
+	clipboardPasteDestination  = "/usr/local/bin/clipboard-paste"
+	clipboardDefaultMaxSize    = 1024 * 1024
+)
+
+// Both shims print the status line to stderr on failure, and pass the content through otherwise
+const clipboardShimStatus = `
+status() {
+	read -r status
+	if [ "$status" != "ok" ]; then
+		echo "clipboard: $status" >&2
+		exit 1
+	fi
+	cat
+}
+`
+
+// Copies stdin to the host clipboard
+var clipboardCopyShim = shimHeader(clipboardSocketDestination) + clipboardShimStatus + `
+{ printf 'set\n'; cat; } | send | status
+`
+
+// Prints the host clipboard
+var clipboardPasteShim = shimHeader(clipboardSocketDestination) + clipboardShimStatus + `
+printf 'get\n' | send | status
+`
+
+// Reads and writes the host clipboard
+type HostClipboard struct {
+	Get func() ([]byte, error)
+	Set func(content []byte) error
+}
+
+type ClipboardPolicy struct {
+	Read    bool
+	Write   bool
+	MaxSize int
+	Log     bool
+}
+
+func ClipboardSocketPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/clipboard", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
+func clipboardShimPath(containerConfig config.ContainerConfig, name string) string {
+	return fmt.Sprintf("%s/%s", config.GetSandboxRuntimeDir(containerConfig.Name), name)
+}
+
+func clipboardEnabled(containerConfig config.ContainerConfig) bool {
+	return containerConfig.Run.Clipboard != "" && containerConfig.Run.Clipboard != ClipboardNone
+}
+
+// Any mode but both limits what the sandbox can see or change
+func clipboardRestricted(containerConfig config.ContainerConfig) bool {
+	return containerConfig.Run.Clipboard != "" && containerConfig.Run.Clipboard != ClipboardBoth
+}
+
+func NewClipboardPolicy(containerConfig config.ContainerConfig) (ClipboardPolicy, error) {
+	var policy ClipboardPolicy = ClipboardPolicy{
+		MaxSize: containerConfig.Run.ClipboardMaxSize,
+		Log:     containerConfig.Run.ClipboardLog,
+	}
+	if policy.MaxSize <= 0 {
+		policy.MaxSize = clipboardDefaultMaxSize
+	}
+
+	switch containerConfig.Run.Clipboard {
+	case "", ClipboardNone:
+	case ClipboardRead:
+		policy.Read = true
+	case ClipboardWrite:
+		policy.Write = true
+	case ClipboardBoth:
+		policy.Read = true
+		policy.Write = true
+	default:
+		return policy, fmt.Errorf("invalid clipboard mode %s, expected none, read, write or both", containerConfig.Run.Clipboard)
+	}
+	return policy, nil
+}
+
+// Uses the wl-clipboard tools on Wayland sessions, and xclip otherwise
+func NewHostClipboard() (HostClipboard, error) {
+	if _, wayland := os.LookupEnv("WAYLAND_DISPLAY"); wayland {
+		if _, err := exec.LookPath("wl-paste"); err == nil {
+			return HostClipboard{
+				Get: func() ([]byte, error) {
+					output, err := exec.Command("wl-paste", "--no-newline").Output()
+					if err != nil {
+						// Fails when nothing was copied
+						return nil, nil
+					}
+					return output, nil
+				},
+				Set: func(content []byte) error {
+					cmd := exec.Command("wl-copy")
+					cmd.Stdin = bytes.NewReader(content)
+					return cmd.Run()
+				},
+			}, nil
+		}
+	}
+
+	if _, err := exec.LookPath("xclip"); err == nil {
+		return HostClipboard{
+			Get: func() ([]byte, error) {
+				output, err := exec.Command("xclip", "-selection", "clipboard", "-o").Output()
+				if err != nil {
+					return nil, nil
+				}
+				return output, nil
+			},
+			Set: func(content []byte) error {
+				cmd := exec.Command("xclip", "-selection", "clipboard", "-i")
+				cmd.Stdin = bytes.NewReader(content)
+				return cmd.Run()
+			},
+		}, nil
+	}
+
+	return HostClipboard{}, fmt.Errorf("no clipboard tool found on the host, install wl-clipboard or xclip")
+}
+
+func handleClipboard(conn net.Conn, name string, policy ClipboardPolicy, host HostClipboard) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	switch strings.TrimSpace(command) {
+	case "get":
+		if !policy.Read {
+			fmt.Fprintln(conn, "refused: reading the host clipboard is not allowed")
+			return
+		}
+		content, err := host.Get()
+		if err != nil {
+			fmt.Fprintf(conn, "failed: %s\n", err)
+			return
+		}
+		if len(content) > policy.MaxSize {
+			fmt.Printf("Clipboard: refused %d bytes to %s, over the limit\n", len(content), name)
+			fmt.Fprintln(conn, "refused: clipboard content over the size limit")
+			return
+		}
+		if policy.Log {
+			fmt.Printf("Clipboard: %s read %d bytes\n", name, len(content))
+		}
+		fmt.Fprintln(conn, "ok")
+		conn.Write(content)
+
+	case "set":
+		if !policy.Write {
+			fmt.Fprintln(conn, "refused: writing the host clipboard is not allowed")
+			return
+		}
+		content, err := io.ReadAll(io.LimitReader(reader, int64(policy.MaxSize)+1))
+		if err != nil {
+			return
+		}
+		if len(content) > policy.MaxSize {
+			fmt.Printf("Clipboard: refused more than %d bytes from %s, over the limit\n", policy.MaxSize, name)
+			fmt.Fprintln(conn, "refused: clipboard content over the size limit")
+			return
+		}
+		if err := host.Set(content); err != nil {
+			fmt.Fprintf(conn, "failed: %s\n", err)
+			return
+		}
+		if policy.Log {
+			fmt.Printf("Clipboard: %s wrote %d bytes\n", name, len(content))
+		}
+		fmt.Fprintln(conn, "ok")
+
+	default:
+		fmt.Fprintln(conn, "refused: unknown command")
+	}
+}
+
+// Relays the host clipboard to clients on listenPath, as allowed by the policy
+func StartClipboardBridge(listenPath string, name string, policy ClipboardPolicy, host HostClipboard) (func(), error) {
+	return startSandboxSocket(listenPath, func(conn net.Conn) {
+		handleClipboard(conn, name, policy, host)
+	})
+}
+
+func Clipboard(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if clipboardEnabled(containerConfig) {
+		spec.Mounts = append(spec.Mounts,
+			specs.Mount{
+				Destination: clipboardSocketDestination,
+				Source:      ClipboardSocketPath(containerConfig),
+				Type:        "bind",
+			},
+			specs.Mount{
+				Destination: clipboardCopyDestination,
+				Source:      clipboardShimPath(containerConfig, "clipboard-copy"),
+				Type:        "bind",
+				Options:     []string{"ro"},
+			},
+			specs.Mount{
+				Destination: clipboardPasteDestination,
+				Source:      clipboardShimPath(containerConfig, "clipboard-paste"),
+				Type:        "bind",
+				Options:     []string{"ro"},
+			},
+		)
+	}
+}
+
+func PrepareClipboard(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	policy, err := NewClipboardPolicy(containerConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Graphical clients use the clipboard of the display server. The relay applies the policy to sandboxes with the
+	// untrusted X11 cookie, trusted X11 and Wayland clients reach the host clipboard whatever it is
+	var restricted bool = clipboardRestricted(containerConfig)
+	if restricted && containerConfig.Run.Wayland {
+		return nil, fmt.Errorf("Clipboard %s can't restrict Wayland clients, the compositor shares the host clipboard with them", containerConfig.Run.Clipboard)
+	}
+	if restricted && containerConfig.Run.X11 && containerConfig.Run.X11Trusted {
+		return nil, fmt.Errorf("Clipboard %s can't restrict trusted X11 clients, unset X11Trusted", containerConfig.Run.Clipboard)
+	}
+	var relay bool = containerConfig.Run.X11 && !containerConfig.Run.X11Trusted && containerConfig.Run.Clipboard != ""
+	if !clipboardEnabled(containerConfig) && !relay {
+		return nil, nil
+	}
+
+	host, err := NewHostClipboard()
+	if err != nil {
+		return nil, err
+	}
+
+	var stops []func()
+	stop := func() {
+		for _, s := range stops {
+			s()
+		}
+	}
+
+	if relay {
+		sandbox, err := sandboxDisplayClipboard(containerConfig)
+		if err != nil {
+			return nil, err
+		}
+		if verbose {
+			fmt.Printf("Clipboard relay: %s (%#v)\n", os.Getenv("DISPLAY"), policy)
+		}
+		stops = append(stops, startClipboardRelay(&clipboardRelay{
+			name:    containerConfig.Name,
+			policy:  policy,
+			host:    host,
+			sandbox: sandbox,
+		}))
+	}
+
+	if !clipboardEnabled(containerConfig) {
+		return stop, nil
+	}
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		stop()
+		return nil, err
+	}
+	shims := map[string]string{
+		"clipboard-copy":  clipboardCopyShim,
+		"clipboard-paste": clipboardPasteShim,
+	}
+	for name, shim := range shims {
+		if err := os.WriteFile(clipboardShimPath(containerConfig, name), []byte(shim), 0755); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+
+	if verbose {
+		fmt.Printf("Clipboard bridge: %s (%#v)\n", ClipboardSocketPath(containerConfig), policy)
+	}
+
+	stopBridge, err := StartClipboardBridge(ClipboardSocketPath(containerConfig), containerConfig.Name, policy, host)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	stops = append(stops, stopBridge)
+	return stop, nil
+}
@@ -0,0 +1,142 @@
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/julioln/sandman/config"
+)
+
+// With the untrusted X11 cookie, the SECURITY extension hides the host clipboard from the sandbox clients, while
+// their own copies are still owned on the host display. The relay joins the display with the same cookie and
+// keeps both sides as the policy allows: host content is copied in when reading is allowed, and sandbox copies
+// stay visible to the host when writing is allowed, they are replaced by the previous host content otherwise.
+
+const clipboardRelayInterval = 500 * time.Millisecond
+
+type clipboardRelay struct {
+	name    string
+	policy  ClipboardPolicy
+	host    HostClipboard
+	sandbox HostClipboard
+	// Known to both sides
+	shared []byte
+	// Host clipboard at the last comparison
+	lastHost []byte
+	// Last content copied on the host, restored over refused sandbox copies
+	hostContent []byte
+	refused     []byte
+}
+
+// The clipboard as seen by the sandbox clients, through xclip with their cookie
+func sandboxDisplayClipboard(containerConfig config.ContainerConfig) (HostClipboard, error) {
+	if _, err := exec.LookPath("xclip"); err != nil {
+		return HostClipboard{}, fmt.Errorf("the X11 clipboard relay needs xclip on the host")
+	}
+
+	env := append(os.Environ(), fmt.Sprintf("XAUTHORITY=%s", XauthorityPath(containerConfig)))
+	return HostClipboard{
+		Get: func() ([]byte, error) {
+			cmd := exec.Command("xclip", "-selection", "clipboard", "-o")
+			cmd.Env = env
+			output, err := cmd.Output()
+			if err != nil {
+				// Nothing copied, or owned by a trusted client
+				return nil, nil
+			}
+			return output, nil
+		},
+		Set: func(content []byte) error {
+			cmd := exec.Command("xclip", "-selection", "clipboard", "-i")
+			cmd.Env = env
+			cmd.Stdin = bytes.NewReader(content)
+			return cmd.Run()
+		},
+	}, nil
+}
+
+// Compares both sides once, applying the policy to what changed since the last time
+func (r *clipboardRelay) sync() {
+	sandboxContent, _ := r.sandbox.Get()
+	hostContent, _ := r.host.Get()
+	if sandboxContent == nil {
+		// Owned on the host again
+		r.refused = nil
+	}
+
+	if sandboxContent != nil && !bytes.Equal(sandboxContent, r.shared) && !bytes.Equal(sandboxContent, r.refused) {
+		// Copied in the sandbox, a host on the same X server already sees it
+		if r.policy.Write && len(sandboxContent) <= r.policy.MaxSize {
+			if !bytes.Equal(hostContent, sandboxContent) {
+				if err := r.host.Set(sandboxContent); err != nil {
+					fmt.Println("Clipboard: failed to relay the sandbox clipboard: ", err)
+					return
+				}
+			}
+			r.shared = sandboxContent
+			r.lastHost = sandboxContent
+			if r.policy.Log {
+				fmt.Printf("Clipboard: %s wrote %d bytes\n", r.name, len(sandboxContent))
+			}
+			return
+		}
+
+		if err := r.host.Set(r.hostContent); err != nil {
+			fmt.Println("Clipboard: failed to restore the host clipboard: ", err)
+			return
+		}
+		// Relayed again on the next comparison when reading is allowed
+		r.shared = nil
+		r.refused = sandboxContent
+		r.lastHost = nil
+		fmt.Printf("Clipboard: refused %d bytes copied in %s\n", len(sandboxContent), r.name)
+		return
+	}
+
+	if hostContent == nil || bytes.Equal(hostContent, r.lastHost) || bytes.Equal(hostContent, r.shared) {
+		r.lastHost = hostContent
+		return
+	}
+	r.lastHost = hostContent
+	r.hostContent = hostContent
+
+	// Copied on the host, hidden from the sandbox until relayed
+	if !r.policy.Read {
+		return
+	}
+	if len(hostContent) > r.policy.MaxSize {
+		fmt.Printf("Clipboard: refused %d bytes to %s, over the limit\n", len(hostContent), r.name)
+		return
+	}
+	if err := r.sandbox.Set(hostContent); err != nil {
+		fmt.Println("Clipboard: failed to relay the host clipboard: ", err)
+		return
+	}
+	r.shared = hostContent
+	if r.policy.Log {
+		fmt.Printf("Clipboard: %s read %d bytes\n", r.name, len(hostContent))
+	}
+}
+
+// Keeps the clipboard of the sandbox display in sync with the host one, the returned function stops it
+func startClipboardRelay(relay *clipboardRelay) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(clipboardRelayInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				relay.sync()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
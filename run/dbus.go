@@ -2,20 +2,177 @@ package run
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 
 	"github.com/containers/podman/v6/pkg/specgen"
 	"github.com/julioln/sandman/config"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+const (
+	dbusProxyCommand       = "xdg-dbus-proxy"
+	dbusSystemBusSocket    = "/run/dbus/system_bus_socket"
+	dbusSessionProxySocket = "bus"
+	dbusSystemProxySocket  = "system_bus"
+)
+
+// The session bus is also shared by the notifications and portals presets
+func DbusSession(containerConfig config.ContainerConfig) bool {
+	return containerConfig.Run.Dbus || containerConfig.Run.Notifications || containerConfig.Run.Portals
+}
+
+// Presets only filter the bus when full access wasn't requested
+func DbusFiltered(containerConfig config.ContainerConfig) bool {
+	return containerConfig.Run.DbusFilter ||
+		len(containerConfig.Run.DbusTalk) > 0 ||
+		len(containerConfig.Run.DbusOwn) > 0 ||
+		len(containerConfig.Run.DbusSee) > 0 ||
+		(!containerConfig.Run.Dbus && DbusSession(containerConfig))
+}
+
+func dbusTalk(containerConfig config.ContainerConfig) []string {
+	var names []string = append([]string{}, containerConfig.Run.DbusTalk...)
+	if containerConfig.Run.Notifications {
+		names = append(names, notificationsBusName)
+	}
+	if containerConfig.Run.Portals {
+		names = append(names, portalsBusName)
+	}
+	if containerConfig.Run.Accessibility {
+		names = append(names, accessibilityBusName)
+	}
+	return names
+}
+
+func DbusProxyPath(containerConfig config.ContainerConfig, socket string) string {
+	return fmt.Sprintf("%s/%s", config.GetSandboxRuntimeDir(containerConfig.Name), socket)
+}
+
+func dbusSessionBusAddress() string {
+	if address, exists := os.LookupEnv("DBUS_SESSION_BUS_ADDRESS"); exists {
+		return address
+	}
+	return fmt.Sprintf("unix:path=%s/bus", os.Getenv("XDG_RUNTIME_DIR"))
+}
+
+func dbusSystemBusAddress() string {
+	if address, exists := os.LookupEnv("DBUS_SYSTEM_BUS_ADDRESS"); exists {
+		return address
+	}
+	return fmt.Sprintf("unix:path=%s", dbusSystemBusSocket)
+}
+
+// Mounts the session bus, or its proxy when filtered. Shared by the configurators that need the bus
+func mountSessionBus(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	var destination string = fmt.Sprintf("%s/bus", os.Getenv("XDG_RUNTIME_DIR"))
+	for _, mount := range spec.Mounts {
+		if mount.Destination == destination {
+			return
+		}
+	}
+
+	var source string = destination
+	if DbusFiltered(containerConfig) {
+		source = DbusProxyPath(containerConfig, dbusSessionProxySocket)
+	}
+
+	spec.Env["DBUS_SESSION_BUS_ADDRESS"] = fmt.Sprintf("unix:path=%s", destination)
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: destination,
+		Source:      source,
+		Type:        "bind",
+	})
+}
+
 func Dbus(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	if containerConfig.Run.Dbus {
-		spec.Env["DBUS_SESSION_BUS_ADDRESS"] = fmt.Sprintf("unix:path=%s/bus", os.Getenv("XDG_RUNTIME_DIR"))
+		mountSessionBus(spec, containerConfig)
+	}
+
+	// The system bus is always filtered
+	if containerConfig.Run.DbusSystem {
+		spec.Env["DBUS_SYSTEM_BUS_ADDRESS"] = fmt.Sprintf("unix:path=%s", dbusSystemBusSocket)
 		spec.Mounts = append(spec.Mounts, specs.Mount{
-			Destination: fmt.Sprintf("%s/bus", os.Getenv("XDG_RUNTIME_DIR")),
-			Source:      fmt.Sprintf("%s/bus", os.Getenv("XDG_RUNTIME_DIR")),
+			Destination: dbusSystemBusSocket,
+			Source:      DbusProxyPath(containerConfig, dbusSystemProxySocket),
 			Type:        "bind",
 		})
 	}
 }
+
+func dbusFilterArgs(containerConfig config.ContainerConfig) []string {
+	var args = []string{"--filter"}
+	for _, name := range dbusTalk(containerConfig) {
+		args = append(args, fmt.Sprintf("--talk=%s", name))
+	}
+	for _, name := range containerConfig.Run.DbusOwn {
+		args = append(args, fmt.Sprintf("--own=%s", name))
+	}
+	for _, name := range containerConfig.Run.DbusSee {
+		args = append(args, fmt.Sprintf("--see=%s", name))
+	}
+	return args
+}
+
+// Arguments for xdg-dbus-proxy, one address, socket and filter set per proxied bus
+func DbusProxyArgs(containerConfig config.ContainerConfig) []string {
+	var args []string
+
+	if DbusSession(containerConfig) && DbusFiltered(containerConfig) {
+		args = append(args, dbusSessionBusAddress(), DbusProxyPath(containerConfig, dbusSessionProxySocket))
+		args = append(args, dbusFilterArgs(containerConfig)...)
+	}
+
+	if containerConfig.Run.DbusSystem {
+		args = append(args, dbusSystemBusAddress(), DbusProxyPath(containerConfig, dbusSystemProxySocket))
+		args = append(args, dbusFilterArgs(containerConfig)...)
+	}
+
+	return args
+}
+
+func PrepareDbus(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	var proxyArgs []string = DbusProxyArgs(containerConfig)
+	if len(proxyArgs) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+
+	// The proxy writes a byte to the pipe once ready, and exits when the read end is closed, also when sandman dies.
+	// A parent death signal would fire when the thread that started it exits instead
+	syncRead, syncWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(dbusProxyCommand, append([]string{"--fd=3"}, proxyArgs...)...)
+	cmd.ExtraFiles = []*os.File{syncWrite}
+	cmd.Stderr = os.Stderr
+
+	if verbose {
+		fmt.Println("Starting D-Bus proxy: ", cmd.Args)
+	}
+
+	if err := cmd.Start(); err != nil {
+		syncRead.Close()
+		syncWrite.Close()
+		return nil, fmt.Errorf("failed to start %s: %w", dbusProxyCommand, err)
+	}
+	syncWrite.Close()
+
+	if _, err := io.ReadFull(syncRead, make([]byte, 1)); err != nil {
+		syncRead.Close()
+		cmd.Wait()
+		return nil, fmt.Errorf("%s exited before being ready", dbusProxyCommand)
+	}
+
+	return func() {
+		syncRead.Close()
+		cmd.Wait()
+	}, nil
+}
@@ -0,0 +1,137 @@
+package run
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/julioln/sandman/config"
+)
+
+// Started sandboxes whose helpers run in sandman are handed to a copy of sandman in its own session, which
+// outlives the container. The command returns once the container runs, with the output of the copy until then.
+// Sandboxes without helpers are started in place.
+
+const detachedEnv = "SANDMAN_DETACHED"
+
+// Written by the detached copy once the container runs
+var detachedReadyFile *os.File
+
+// The output of the detached copy
+func DetachedLogPath(containerConfig config.ContainerConfig) string {
+	return filepath.Join(config.GetSandboxRuntimeDir(containerConfig.Name), "sandman.log")
+}
+
+// Started hooks need the container, their helpers are known from the configuration
+func startedHelpers(containerConfig config.ContainerConfig) bool {
+	if len(containerConfig.Run.Egress) > 0 || (containerConfig.Run.UsbHotplug && len(containerConfig.Run.UsbDevices) > 0) {
+		return true
+	}
+	services, _ := parseHostServices(containerConfig)
+	for _, service := range services {
+		if service.Network == "tcp" {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs f with its output held back, so it isn't printed twice when the detached copy runs it again
+func captureOutput(f func()) []byte {
+	file, err := os.CreateTemp("", "sandman-output")
+	if err != nil {
+		f()
+		return nil
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+
+	stdout := os.Stdout
+	os.Stdout = file
+	f()
+	os.Stdout = stdout
+
+	file.Seek(0, io.SeekStart)
+	output, _ := io.ReadAll(file)
+	return output
+}
+
+// Runs the start command again in a new session, returning the exit code of the command
+func startDetached(containerConfig config.ContainerConfig) int {
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Println("Failed to detach: ", err)
+		return 1
+	}
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		fmt.Println("Failed to detach: ", err)
+		return 1
+	}
+	// Helpers inherit the output, a file never blocks them once this process exits
+	logFile, err := os.OpenFile(DetachedLogPath(containerConfig), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Println("Failed to detach: ", err)
+		return 1
+	}
+	defer logFile.Close()
+	output, err := os.Open(DetachedLogPath(containerConfig))
+	if err != nil {
+		fmt.Println("Failed to detach: ", err)
+		return 1
+	}
+	defer output.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		fmt.Println("Failed to detach: ", err)
+		return 1
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), detachedEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		fmt.Println("Failed to detach: ", err)
+		return 1
+	}
+
+	ready := make(chan bool)
+	go func() {
+		n, _ := readyReader.Read(make([]byte, 1))
+		ready <- n == 1
+	}()
+
+	for {
+		select {
+		case running := <-ready:
+			io.Copy(os.Stdout, output)
+			if running {
+				fmt.Println("Sandbox output continues in: ", DetachedLogPath(containerConfig))
+				return 0
+			}
+			// Exited before the container ran
+			cmd.Wait()
+			return max(cmd.ProcessState.ExitCode(), 1)
+		case <-time.After(100 * time.Millisecond):
+			io.Copy(os.Stdout, output)
+		}
+	}
+}
+
+// Tells the starting command the container runs, in the detached copy
+func detachedReady() {
+	if detachedReadyFile != nil {
+		detachedReadyFile.Write([]byte{1})
+		detachedReadyFile.Close()
+		detachedReadyFile = nil
+	}
+}
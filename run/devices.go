@@ -1,15 +1,175 @@
 package run
 
 import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
 	"github.com/containers/podman/v6/pkg/specgen"
 	"github.com/julioln/sandman/config"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+const (
+	MissingDevicesWarn  = "warn"
+	MissingDevicesError = "error"
+)
+
+var (
+	devicePermissions = regexp.MustCompile(`^r?w?m?$`)
+	deviceCgroupRule  = regexp.MustCompile(`^([abc]) (\*|[0-9]+):(\*|[0-9]+) ([rwm]{1,3})$`)
+)
+
+// A device entry, source[:destination][:permissions]. The source may be a glob or a symlink such as a by-id path
+type DeviceEntry struct {
+	Source      string
+	Destination string
+	Permissions string
+}
+
+func ParseDeviceEntry(entry string) (DeviceEntry, error) {
+	var d DeviceEntry
+	fields := strings.Split(entry, ":")
+	d.Source = fields[0]
+
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "/") && d.Destination == "" && d.Permissions == "":
+			d.Destination = field
+		case field != "" && devicePermissions.MatchString(field) && d.Permissions == "":
+			d.Permissions = field
+		default:
+			return d, fmt.Errorf("invalid device %s, expected path[:destination][:r|rw|rwm]", entry)
+		}
+	}
+
+	if !strings.HasPrefix(d.Source, "/") {
+		return d, fmt.Errorf("invalid device %s, must be an absolute path", entry)
+	}
+	return d, nil
+}
+
+// Expands the globs and resolves symlinks, returning the host device paths
+func (d DeviceEntry) Resolve() ([]string, error) {
+	var matches []string = []string{d.Source}
+	if strings.ContainsAny(d.Source, "*?[") {
+		var err error
+		if matches, err = filepath.Glob(d.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []string
+	for _, match := range matches {
+		path, err := filepath.EvalSymlinks(match)
+		if err != nil {
+			continue
+		}
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no device found for %s", d.Source)
+	}
+	if d.Destination != "" && len(paths) > 1 {
+		return nil, fmt.Errorf("%s matches %d devices, a destination needs a single one", d.Source, len(paths))
+	}
+	return paths, nil
+}
+
+// In the format podman parses, host[:container][:permissions]
+func (d DeviceEntry) devicePath(path string) string {
+	var fields []string = []string{path}
+	if d.Destination != "" {
+		fields = append(fields, d.Destination)
+	}
+	if d.Permissions != "" {
+		fields = append(fields, d.Permissions)
+	}
+	return strings.Join(fields, ":")
+}
+
+// Parses a device cgroup rule, e.g. "c 13:* rwm"
+func ParseDeviceCgroupRule(rule string) (specs.LinuxDeviceCgroup, error) {
+	var r specs.LinuxDeviceCgroup
+	fields := deviceCgroupRule.FindStringSubmatch(strings.TrimSpace(rule))
+	if fields == nil {
+		return r, fmt.Errorf("invalid device cgroup rule %s, expected \"type major:minor access\" (e.g. \"c 13:* rwm\")", rule)
+	}
+
+	r.Allow = true
+	r.Type = fields[1]
+	r.Access = fields[4]
+	if fields[2] != "*" {
+		major, _ := strconv.ParseInt(fields[2], 10, 64)
+		r.Major = &major
+	}
+	if fields[3] != "*" {
+		minor, _ := strconv.ParseInt(fields[3], 10, 64)
+		r.Minor = &minor
+	}
+	return r, nil
+}
+
 func Devices(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	for _, dev := range containerConfig.Run.Devices {
-		spec.Devices = append(spec.Devices, specs.LinuxDevice{
-			Path: dev,
-		})
+		entry, err := ParseDeviceEntry(dev)
+		if err != nil {
+			fmt.Println("Ignoring device: ", err)
+			continue
+		}
+
+		paths, err := entry.Resolve()
+		if err != nil {
+			fmt.Println("Ignoring device: ", err)
+			continue
+		}
+
+		for _, path := range paths {
+			spec.Devices = append(spec.Devices, specs.LinuxDevice{
+				Path: entry.devicePath(path),
+			})
+		}
+	}
+
+	for _, rule := range containerConfig.Run.DeviceCgroupRules {
+		r, err := ParseDeviceCgroupRule(rule)
+		if err != nil {
+			fmt.Println("Ignoring device cgroup rule: ", err)
+			continue
+		}
+		spec.DeviceCgroupRule = append(spec.DeviceCgroupRule, r)
+	}
+}
+
+// Invalid entries always abort, missing devices only when configured to
+func PrepareDevices(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	switch containerConfig.Run.MissingDevices {
+	case "", MissingDevicesWarn, MissingDevicesError:
+	default:
+		return nil, fmt.Errorf("invalid MissingDevices %s, expected warn or error", containerConfig.Run.MissingDevices)
+	}
+
+	for _, dev := range containerConfig.Run.Devices {
+		entry, err := ParseDeviceEntry(dev)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := entry.Resolve(); err != nil && containerConfig.Run.MissingDevices == MissingDevicesError {
+			return nil, err
+		}
 	}
+
+	for _, rule := range containerConfig.Run.DeviceCgroupRules {
+		if _, err := ParseDeviceCgroupRule(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
 }
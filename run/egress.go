@@ -0,0 +1,569 @@
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// With an egress allowlist the container only has a loopback interface. Sandman serves, in its network namespace,
+// an HTTP proxy (CONNECT or absolute URLs), a DNS server answering allowed names with 127.0.0.1, and the ports of
+// the allowed names, routed by TLS SNI or HTTP Host. Everything else is refused and logged.
+
+const (
+	egressListenIP    = "127.0.0.1"
+	egressProxyPort   = 3128
+	egressDnsPort     = 53
+	egressResolvConf  = "egress-resolv.conf"
+	egressDnsTTL      = 60
+	egressDialTimeout = 30 * time.Second
+	egressPeekSize    = 16 * 1024
+
+	dnsHeaderSize = 12
+	dnsTypeA      = 1
+	dnsClassIN    = 1
+	dnsRcodeNX    = 3
+)
+
+// Default ports of the transparent listeners, for rules without a port
+var egressDefaultPorts = []uint16{80, 443}
+
+// Shared address space of carrier grade NAT, not covered by IsPrivate
+var egressCGNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+var egressHostname = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// An allowed destination, a hostname (*.example.com matches subdomains) or network, on a port or any of them
+type EgressRule struct {
+	Host    string
+	Network *net.IPNet
+	Port    uint16
+}
+
+// Parses host[:port], ip[:port] or cidr[:port], IPv6 in brackets when followed by a port, e.g. [fd00::/8]:443
+func ParseEgressRule(entry string) (EgressRule, error) {
+	var rule EgressRule
+	var destination string = strings.ToLower(strings.TrimSpace(entry))
+
+	var port string
+	if strings.HasPrefix(destination, "[") {
+		address, rest, found := strings.Cut(destination[1:], "]")
+		if !found || (rest != "" && !strings.HasPrefix(rest, ":")) {
+			return rule, fmt.Errorf("invalid egress %s, expected [address]:port", entry)
+		}
+		destination, port = address, strings.TrimPrefix(rest, ":")
+	} else if strings.Count(destination, ":") == 1 {
+		destination, port, _ = strings.Cut(destination, ":")
+	}
+	if port != "" || strings.HasSuffix(entry, ":") {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return rule, fmt.Errorf("invalid egress %s, invalid port %s", entry, port)
+		}
+		rule.Port = uint16(p)
+	}
+
+	if _, network, err := net.ParseCIDR(destination); err == nil {
+		rule.Network = network
+		return rule, nil
+	}
+	if ip := net.ParseIP(destination); ip != nil {
+		rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		return rule, nil
+	}
+	if !egressHostname.MatchString(destination) {
+		return rule, fmt.Errorf("invalid egress %s, expected a hostname, IP or CIDR", entry)
+	}
+	rule.Host = destination
+	return rule, nil
+}
+
+func (r EgressRule) matchesHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if suffix, wildcard := strings.CutPrefix(r.Host, "*"); wildcard {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return r.Host != "" && host == r.Host
+}
+
+func (r EgressRule) Allows(host string, port uint16) bool {
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+	if r.Network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.Network.Contains(ip)
+	}
+	return r.matchesHost(host)
+}
+
+func ParseEgressRules(entries []string) ([]EgressRule, error) {
+	var rules []EgressRule
+	for _, entry := range entries {
+		rule, err := ParseEgressRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Host != "" && (rule.Port == egressProxyPort || rule.Port == egressDnsPort) {
+			return nil, fmt.Errorf("invalid egress %s, port %d is used by the sandbox proxy", entry, rule.Port)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Ports routed by SNI or Host header, those of the hostname rules
+func egressPorts(rules []EgressRule) []uint16 {
+	var ports []uint16
+	for _, rule := range rules {
+		if rule.Host == "" {
+			continue
+		}
+		candidates := []uint16{rule.Port}
+		if rule.Port == 0 {
+			candidates = egressDefaultPorts
+		}
+		for _, port := range candidates {
+			if !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+type egressProxy struct {
+	rules   []EgressRule
+	dial    func(network string, address string) (net.Conn, error)
+	verbose bool
+}
+
+func newEgressProxy(rules []EgressRule, verbose bool) *egressProxy {
+	p := &egressProxy{rules: rules, verbose: verbose}
+	dialer := &net.Dialer{Timeout: egressDialTimeout, Control: p.checkDestination}
+	p.dial = dialer.Dial
+	return p
+}
+
+// Host local and private addresses, hostname rules resolving to them would reach the host or its network
+func egressRestrictedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || egressCGNAT.Contains(ip)
+}
+
+// Checks the resolved address before connecting, restricted ones are only dialed when an IP or CIDR rule allows them
+func (p *egressProxy) checkDestination(network string, address string, _ syscall.RawConn) error {
+	host, port, err := splitHostPort(address, 0)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("egress to %s denied, not an IP", address)
+	}
+	if !egressRestrictedIP(ip) {
+		return nil
+	}
+	for _, rule := range p.rules {
+		if rule.Network != nil && rule.Allows(host, port) {
+			return nil
+		}
+	}
+	fmt.Printf("Egress denied (resolved): %s\n", address)
+	return fmt.Errorf("egress to %s denied, a local or private address", address)
+}
+
+func (p *egressProxy) allowed(via string, host string, port uint16) bool {
+	for _, rule := range p.rules {
+		if rule.Allows(host, port) {
+			if p.verbose {
+				fmt.Printf("Egress allowed (%s): %s\n", via, net.JoinHostPort(host, strconv.Itoa(int(port))))
+			}
+			return true
+		}
+	}
+	fmt.Printf("Egress denied (%s): %s\n", via, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	return false
+}
+
+func splitHostPort(hostPort string, defaultPort uint16) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// No port
+		return strings.Trim(hostPort, "[]"), defaultPort, nil
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %s", port)
+	}
+	return host, uint16(p), nil
+}
+
+// HTTP proxy, CONNECT tunnels and plain requests to absolute URLs
+func (p *egressProxy) serveProxyClient(client net.Conn) {
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	for {
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+
+		if request.Method == http.MethodConnect {
+			p.tunnel(client, reader, request)
+			return
+		}
+		// Each request is checked, as kept alive connections may change host
+		if !p.forward(client, request) || request.Close {
+			return
+		}
+	}
+}
+
+func (p *egressProxy) tunnel(client net.Conn, reader *bufio.Reader, request *http.Request) {
+	host, port, err := splitHostPort(request.Host, 443)
+	if err != nil || !p.allowed("proxy", host, port) {
+		fmt.Fprint(client, "HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	upstream, err := p.dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		fmt.Fprint(client, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+		return
+	}
+	fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	// Anything the client sent after the request
+	if reader.Buffered() > 0 {
+		buffered, _ := reader.Peek(reader.Buffered())
+		if _, err := upstream.Write(buffered); err != nil {
+			upstream.Close()
+			return
+		}
+	}
+	relayConns(client, upstream)
+}
+
+// Returns whether the client connection can be reused
+func (p *egressProxy) forward(client net.Conn, request *http.Request) bool {
+	if request.URL.Host == "" {
+		fmt.Fprint(client, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return false
+	}
+	var defaultPort uint16 = 80
+	if request.URL.Scheme == "https" {
+		defaultPort = 443
+	}
+	host, port, err := splitHostPort(request.URL.Host, defaultPort)
+	if err != nil || !p.allowed("proxy", host, port) {
+		fmt.Fprint(client, "HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n")
+		return false
+	}
+
+	upstream, err := p.dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		fmt.Fprint(client, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+		return false
+	}
+	defer upstream.Close()
+
+	request.Header.Del("Proxy-Connection")
+	request.Header.Del("Proxy-Authorization")
+	if err := request.Write(upstream); err != nil {
+		return false
+	}
+	response, err := http.ReadResponse(bufio.NewReader(upstream), request)
+	if err != nil {
+		fmt.Fprint(client, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+		return false
+	}
+	defer response.Body.Close()
+	return response.Write(client) == nil && !response.Close
+}
+
+// Only reads, so a failed TLS handshake doesn't answer the client
+type peekConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c peekConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c peekConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+var errSniFound = errors.New("server name found")
+
+// Reads the server name of a TLS client hello or the Host of an HTTP request, returning what was read
+func peekServerName(client net.Conn) (string, []byte, error) {
+	var peeked bytes.Buffer
+	reader := io.TeeReader(io.LimitReader(client, egressPeekSize), &peeked)
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(reader, first); err != nil {
+		return "", nil, err
+	}
+	replay := io.MultiReader(bytes.NewReader(first), reader)
+
+	// TLS handshake record
+	if first[0] == 0x16 {
+		var serverName string
+		err := tls.Server(peekConn{client, replay}, &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				serverName = hello.ServerName
+				return nil, errSniFound
+			},
+		}).Handshake()
+		if serverName == "" {
+			return "", nil, fmt.Errorf("no TLS server name: %w", err)
+		}
+		return serverName, peeked.Bytes(), nil
+	}
+
+	request, err := http.ReadRequest(bufio.NewReader(replay))
+	if err != nil {
+		return "", nil, fmt.Errorf("neither TLS nor HTTP: %w", err)
+	}
+	host, _, _ := splitHostPort(request.Host, 0)
+	if host == "" {
+		return "", nil, fmt.Errorf("no HTTP host")
+	}
+	return host, peeked.Bytes(), nil
+}
+
+// Connections to an allowed name, which resolved to the loopback address
+func (p *egressProxy) serveTransparentClient(client net.Conn, port uint16) {
+	defer client.Close()
+
+	client.SetReadDeadline(time.Now().Add(egressDialTimeout))
+	host, peeked, err := peekServerName(client)
+	if err != nil {
+		fmt.Printf("Egress denied (port %d): %s\n", port, err)
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+
+	if !p.allowed("sni", host, port) {
+		return
+	}
+	upstream, err := p.dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return
+	}
+	if _, err := upstream.Write(peeked); err != nil {
+		upstream.Close()
+		return
+	}
+	relayConns(client, upstream)
+}
+
+// Answers a DNS query, A records of allowed names point to the transparent listeners
+func (p *egressProxy) dnsAnswer(query []byte) ([]byte, bool) {
+	if len(query) < dnsHeaderSize || query[2]&0x80 != 0 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil, false
+	}
+
+	var labels []string
+	var offset int = dnsHeaderSize
+	for offset < len(query) && query[offset] != 0 {
+		length := int(query[offset])
+		if length > 63 || offset+1+length > len(query) {
+			return nil, false
+		}
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	if offset+5 > len(query) {
+		return nil, false
+	}
+	var questionEnd int = offset + 5
+	qtype := binary.BigEndian.Uint16(query[offset+1:])
+	qclass := binary.BigEndian.Uint16(query[offset+3:])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	response := make([]byte, questionEnd)
+	copy(response, query[:questionEnd])
+	// Response, recursion desired copied, recursion available
+	response[2] = 0x80 | query[2]&0x79
+	response[3] = 0x80
+	binary.BigEndian.PutUint16(response[6:], 0)
+	binary.BigEndian.PutUint16(response[8:], 0)
+	binary.BigEndian.PutUint16(response[10:], 0)
+
+	if !slices.ContainsFunc(p.rules, func(r EgressRule) bool { return r.matchesHost(name) }) {
+		fmt.Printf("Egress denied (dns): %s\n", name)
+		response[3] |= dnsRcodeNX
+		return response, true
+	}
+	if p.verbose {
+		fmt.Printf("Egress allowed (dns): %s\n", name)
+	}
+
+	// Other record types have no answer, so clients use IPv4
+	if qtype == dnsTypeA && qclass == dnsClassIN {
+		binary.BigEndian.PutUint16(response[6:], 1)
+		response = append(response, 0xc0, dnsHeaderSize)
+		response = binary.BigEndian.AppendUint16(response, dnsTypeA)
+		response = binary.BigEndian.AppendUint16(response, dnsClassIN)
+		response = binary.BigEndian.AppendUint32(response, egressDnsTTL)
+		response = binary.BigEndian.AppendUint16(response, 4)
+		response = append(response, net.ParseIP(egressListenIP).To4()...)
+	}
+	return response, true
+}
+
+func (p *egressProxy) serveDns(conn net.PacketConn) {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response, ok := p.dnsAnswer(buffer[:n]); ok {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// Starts the proxy on the listeners, the first one is the HTTP proxy followed by the ports of egressPorts.
+// Stops when the listeners are closed
+func (p *egressProxy) serve(dns net.PacketConn, listeners []net.Listener) {
+	go p.serveDns(dns)
+	go serveListener(listeners[0], p.serveProxyClient)
+	for i, port := range egressPorts(p.rules) {
+		go serveListener(listeners[i+1], func(client net.Conn) {
+			p.serveTransparentClient(client, port)
+		})
+	}
+}
+
+func egressResolvConfPath(containerConfig config.ContainerConfig) string {
+	return filepath.Join(config.GetSandboxRuntimeDir(containerConfig.Name), egressResolvConf)
+}
+
+func Egress(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if len(containerConfig.Run.Egress) == 0 {
+		return
+	}
+
+	// The network namespace is set up by Network, the resolver by PrepareEgress
+	var proxy string = fmt.Sprintf("http://%s:%d", egressListenIP, egressProxyPort)
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		spec.Env[name] = proxy
+	}
+	spec.Env["NO_PROXY"] = "localhost,127.0.0.1"
+	spec.Env["no_proxy"] = spec.Env["NO_PROXY"]
+
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Source:      egressResolvConfPath(containerConfig),
+		Destination: "/etc/resolv.conf",
+		Type:        "bind",
+		Options:     []string{"ro"},
+	})
+}
+
+func PrepareEgress(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if len(containerConfig.Run.Egress) == 0 {
+		return nil, nil
+	}
+	if containerConfig.Run.Net || (containerConfig.Run.Network != "" && containerConfig.Run.Network != "none") {
+		return nil, fmt.Errorf("Egress replaces the network, remove Net and Network")
+	}
+	if _, err := ParseEgressRules(containerConfig.Run.Egress); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+	resolvConf := fmt.Sprintf("nameserver %s\n", egressListenIP)
+	if err := os.WriteFile(egressResolvConfPath(containerConfig), []byte(resolvConf), 0644); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Serves the allowlist in the network namespace of the container
+func StartEgress(conn context.Context, containerID string, containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if len(containerConfig.Run.Egress) == 0 {
+		return nil, nil
+	}
+
+	rules, err := ParseEgressRules(containerConfig.Run.Egress)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := containerPid(conn, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string = []string{
+		fmt.Sprintf("udp:%s:%d", egressListenIP, egressDnsPort),
+		fmt.Sprintf("tcp:%s:%d", egressListenIP, egressProxyPort),
+	}
+	for _, port := range egressPorts(rules) {
+		addresses = append(addresses, fmt.Sprintf("tcp:%s:%d", egressListenIP, port))
+	}
+	files, err := listenInNetns(pid, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var closers []io.Closer
+	stop := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	dns, err := net.FilePacketConn(files[0])
+	if err != nil {
+		return nil, err
+	}
+	closers = append(closers, dns)
+
+	var listeners []net.Listener
+	for _, file := range files[1:] {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		closers = append(closers, listener)
+		listeners = append(listeners, listener)
+	}
+
+	if verbose {
+		fmt.Println("Egress allowlist: ", containerConfig.Run.Egress)
+	}
+	newEgressProxy(rules, verbose).serve(dns, listeners)
+
+	return stop, nil
+}
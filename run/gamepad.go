@@ -0,0 +1,52 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/citilinkru/libudev/matcher"
+	"github.com/citilinkru/libudev/types"
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const uinputPath = "/dev/uinput"
+
+// Joystick input nodes, along with the hidraw nodes of the same devices used by some pads
+func GamepadPaths(devices []*types.Device) []string {
+	gamepads := matchDevices(devices,
+		matcher.NewRuleEnv("SUBSYSTEM", "^input$"),
+		matcher.NewRuleEnv("ID_INPUT_JOYSTICK", "^1$"),
+	)
+
+	paths := append(devicePaths(gamepads), devicePaths(siblingDevices(devices, gamepads, "hidraw"))...)
+	slices.Sort(paths)
+	return paths
+}
+
+func Gamepad(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.Gamepad {
+		devices, err := scanDevices()
+		if err != nil {
+			fmt.Println("Failed to list gamepads, ignoring.")
+			return
+		}
+
+		var paths []string = GamepadPaths(devices)
+
+		// Virtual devices can inject any input into the host session, so only when asked for
+		if containerConfig.Run.GamepadUinput {
+			if _, err := os.Stat(uinputPath); err == nil {
+				paths = append(paths, uinputPath)
+			}
+		}
+
+		for _, path := range paths {
+			spec.Devices = append(spec.Devices, specs.LinuxDevice{
+				Path: path,
+			})
+		}
+	}
+}
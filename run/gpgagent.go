@@ -0,0 +1,48 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// The extra socket is the restricted one meant for forwarding, it can sign and decrypt but not manage keys
+func gpgAgentExtraSocket() string {
+	if output, err := exec.Command("gpgconf", "--list-dirs", "agent-extra-socket").Output(); err == nil {
+		return strings.TrimSpace(string(output))
+	}
+	return fmt.Sprintf("%s/gnupg/S.gpg-agent.extra", os.Getenv("XDG_RUNTIME_DIR"))
+}
+
+func gpgHomeDir() string {
+	if home, exists := os.LookupEnv("GNUPGHOME"); exists {
+		return home
+	}
+	home, _ := os.UserHomeDir()
+	return fmt.Sprintf("%s/.gnupg", home)
+}
+
+func GpgAgent(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.GpgAgent {
+		var socket string = gpgAgentExtraSocket()
+		var gnupgHome string = filepath.Join(containerHomeDir(containerConfig), ".gnupg")
+
+		// gpg only uses /run/user/<uid> when the container user owns it, which the runtime directories mounted
+		// from the host never are, so it looks for the agent in its home. The home is set, whatever the user
+		spec.Env["GNUPGHOME"] = gnupgHome
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: filepath.Join(gnupgHome, "S.gpg-agent"),
+			Source:      socket,
+			Type:        "bind",
+		})
+
+		// Public keys only, the private ones stay with the agent
+		mountReadOnlyIfExists(spec, filepath.Join(gpgHomeDir(), "pubring.kbx"), filepath.Join(gnupgHome, "pubring.kbx"))
+	}
+}
@@ -1,16 +1,178 @@
 package run
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
 	"github.com/containers/podman/v6/pkg/specgen"
 	"github.com/julioln/sandman/config"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	GpuNone       = "none"
+	GpuFull       = "full"
+	GpuRenderOnly = "render-only"
+
+	driPath      = "/dev/dri"
+	pciSysfsRoot = "/sys/bus/pci/devices"
 )
 
+// In order of priority, specs in /var/run/cdi override the ones in /etc/cdi
+var cdiSpecDirs = []string{"/var/run/cdi", "/etc/cdi"}
+
+func gpuMode(containerConfig config.ContainerConfig) string {
+	if containerConfig.Run.Gpu != "" {
+		return string(containerConfig.Run.Gpu)
+	}
+	if containerConfig.Run.Dri {
+		return GpuFull
+	}
+	return GpuNone
+}
+
+// CDI device names are qualified by their kind, vendor.com/class=name
+func IsCdiDevice(name string) bool {
+	kind, device, found := strings.Cut(name, "=")
+	vendor, class, hasClass := strings.Cut(kind, "/")
+	return found && hasClass && device != "" && strings.Contains(vendor, ".") && class != ""
+}
+
+type cdiDeviceNode struct {
+	Path string `yaml:"path"`
+}
+
+type cdiContainerEdits struct {
+	DeviceNodes []cdiDeviceNode `yaml:"deviceNodes"`
+}
+
+type cdiSpec struct {
+	Kind    string `yaml:"kind"`
+	Devices []struct {
+		Name           string            `yaml:"name"`
+		ContainerEdits cdiContainerEdits `yaml:"containerEdits"`
+	} `yaml:"devices"`
+	ContainerEdits cdiContainerEdits `yaml:"containerEdits"`
+}
+
+// Finds a CDI device in the spec files (JSON or YAML) of the directories, returning its device nodes
+func ResolveCdiDevice(name string, dirs []string) ([]string, error) {
+	kind, deviceName, _ := strings.Cut(name, "=")
+	var available []string
+
+	for _, dir := range dirs {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		slices.Sort(files)
+		for _, file := range files {
+			if ext := filepath.Ext(file); ext != ".json" && ext != ".yaml" && ext != ".yml" {
+				continue
+			}
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			var spec cdiSpec
+			if err := yaml.Unmarshal(data, &spec); err != nil {
+				return nil, fmt.Errorf("invalid CDI spec %s: %w", file, err)
+			}
+			if spec.Kind != kind {
+				continue
+			}
+
+			for _, device := range spec.Devices {
+				if device.Name != deviceName {
+					available = append(available, device.Name)
+					continue
+				}
+				var nodes []string
+				for _, node := range append(spec.ContainerEdits.DeviceNodes, device.ContainerEdits.DeviceNodes...) {
+					nodes = append(nodes, node.Path)
+				}
+				return nodes, nil
+			}
+		}
+	}
+
+	if len(available) == 0 {
+		return nil, fmt.Errorf("no CDI spec found for %s in %s", kind, strings.Join(dirs, ", "))
+	}
+	return nil, fmt.Errorf("CDI device %s not found, available: %s", name, strings.Join(available, ", "))
+}
+
+// DRM nodes of the GPU at the PCI address (e.g. 0000:01:00.0)
+func PciDriNodes(sysfsRoot string, address string, renderOnly bool) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(sysfsRoot, address, "drm"))
+	if err != nil {
+		return nil, fmt.Errorf("no GPU found at PCI address %s", address)
+	}
+
+	var nodes []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "renderD") || (!renderOnly && strings.HasPrefix(name, "card")) {
+			nodes = append(nodes, fmt.Sprintf("%s/%s", driPath, name))
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("GPU at PCI address %s has no DRM nodes", address)
+	}
+	return nodes, nil
+}
+
+// Returns the device paths of the mode, or the CDI device name
+func GpuDevices(containerConfig config.ContainerConfig) ([]string, error) {
+	var mode string = gpuMode(containerConfig)
+	var renderOnly bool = mode == GpuRenderOnly
+
+	switch {
+	case mode == GpuNone:
+		return nil, nil
+	case IsCdiDevice(mode) && containerConfig.Run.GpuPci != "":
+		// The CDI device name already selects the GPU
+		return nil, fmt.Errorf("GpuPci %s can't be combined with the CDI device %s", containerConfig.Run.GpuPci, mode)
+	case IsCdiDevice(mode):
+		if _, err := ResolveCdiDevice(mode, cdiSpecDirs); err != nil {
+			return nil, err
+		}
+		// Podman applies the CDI spec
+		return []string{mode}, nil
+	case mode != GpuFull && mode != GpuRenderOnly:
+		return nil, fmt.Errorf("invalid Gpu %s, expected none, full, render-only or a CDI device (e.g. nvidia.com/gpu=all)", mode)
+	case containerConfig.Run.GpuPci != "":
+		return PciDriNodes(pciSysfsRoot, containerConfig.Run.GpuPci, renderOnly)
+	case renderOnly:
+		return filepath.Glob(fmt.Sprintf("%s/renderD*", driPath))
+	}
+	return []string{driPath}, nil
+}
+
 func Gpu(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	// Expose Direct Render Inteface for GPU acceleration
-	if containerConfig.Run.Dri || containerConfig.Run.Gpu {
+	devices, err := GpuDevices(containerConfig)
+	if err != nil {
+		fmt.Println("Ignoring GPU: ", err)
+		return
+	}
+
+	for _, dev := range devices {
 		spec.Devices = append(spec.Devices, specs.LinuxDevice{
-			Path: "/dev/dri",
+			Path: dev,
 		})
 	}
 }
+
+func PrepareGpu(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	devices, err := GpuDevices(containerConfig)
+	if err != nil {
+		return nil, err
+	}
+	if verbose && len(devices) > 0 {
+		fmt.Println("GPU devices: ", devices)
+	}
+	return nil, nil
+}
@@ -9,18 +9,20 @@ import (
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+// Allow destination to be overriden
+func containerHomeDir(containerConfig config.ContainerConfig) string {
+	if containerConfig.Run.HomePath != "" {
+		return containerConfig.Run.HomePath
+	}
+	return "/home/user"
+}
+
 func Home(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	if containerConfig.Run.Home {
 		var mountPoint = fmt.Sprintf("%s/%s", config.GetHomeStorageDir(), containerConfig.Name)
 		if err := os.MkdirAll(mountPoint, 0755); err == nil {
-			// Allow destination to be overriden
-			var destination = "/home/user"
-			if containerConfig.Run.HomePath != "" {
-				destination = containerConfig.Run.HomePath
-			}
-
 			spec.Mounts = append(spec.Mounts, specs.Mount{
-				Destination: destination,
+				Destination: containerHomeDir(containerConfig),
 				Source:      mountPoint,
 				Type:        "bind",
 			})
@@ -0,0 +1,255 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Host services are relayed by sandman, without a route to the host. TCP services listen on the same port of the
+// container loopback, IPv4 and IPv6, in its network namespace, unix sockets are mounted at the same path.
+
+// A host service, tcp:host:port or unix:/path
+type HostService struct {
+	Network string
+	Address string
+	Port    int
+}
+
+func ParseHostService(entry string) (HostService, error) {
+	var service HostService
+	network, address, _ := strings.Cut(entry, ":")
+	service.Network = network
+	service.Address = address
+
+	switch network {
+	case "tcp":
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return service, fmt.Errorf("invalid host service %s, expected tcp:host:port", entry)
+		}
+		if service.Port, err = strconv.Atoi(port); err != nil || service.Port < 1 || service.Port > 65535 {
+			return service, fmt.Errorf("invalid host service %s, invalid port %s", entry, port)
+		}
+	case "unix":
+		if !filepath.IsAbs(address) {
+			return service, fmt.Errorf("invalid host service %s, the socket path must be absolute", entry)
+		}
+	default:
+		return service, fmt.Errorf("invalid host service %s, expected tcp:host:port or unix:/path", entry)
+	}
+	return service, nil
+}
+
+func parseHostServices(containerConfig config.ContainerConfig) ([]HostService, error) {
+	var services []HostService
+	var ports []int
+	for _, entry := range containerConfig.Run.HostServices {
+		service, err := ParseHostService(entry)
+		if err != nil {
+			return nil, err
+		}
+		if service.Network == "tcp" {
+			for _, port := range ports {
+				if port == service.Port {
+					return nil, fmt.Errorf("host service %s, port %d is relayed twice", entry, port)
+				}
+			}
+			ports = append(ports, service.Port)
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// The relay socket mounted in the container, by position in HostServices
+func hostServiceSocketPath(containerConfig config.ContainerConfig, index int) string {
+	return filepath.Join(config.GetSandboxRuntimeDir(containerConfig.Name), fmt.Sprintf("host-service-%d.sock", index))
+}
+
+// Forwards every client to the service, until the listener is closed
+func serveHostService(listener net.Listener, service HostService) {
+	serveListener(listener, func(client net.Conn) {
+		upstream, err := net.Dial(service.Network, service.Address)
+		if err != nil {
+			fmt.Printf("Host service %s:%s unavailable: %s\n", service.Network, service.Address, err)
+			client.Close()
+			return
+		}
+		relayConns(client, upstream)
+	})
+}
+
+func HostServices(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	for i, entry := range containerConfig.Run.HostServices {
+		service, err := ParseHostService(entry)
+		if err != nil {
+			fmt.Println("Ignoring host service: ", err)
+			continue
+		}
+		if service.Network != "unix" {
+			continue
+		}
+
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Source:      hostServiceSocketPath(containerConfig, i),
+			Destination: service.Address,
+			Type:        "bind",
+		})
+	}
+}
+
+// Validates the services and relays the unix sockets, TCP ones need the running container
+func PrepareHostServices(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	services, err := parseHostServices(containerConfig)
+	if err != nil || len(services) == 0 {
+		return nil, err
+	}
+
+	networkNS, _, err := parseNetwork(containerConfig)
+	if err != nil {
+		return nil, err
+	}
+	if networkNS.NSMode == specgen.Host {
+		return nil, fmt.Errorf("HostServices need a network namespace, the host network already reaches them")
+	}
+
+	var reserved []int
+	if len(containerConfig.Run.Egress) > 0 {
+		rules, err := ParseEgressRules(containerConfig.Run.Egress)
+		if err != nil {
+			return nil, err
+		}
+		reserved = append(reserved, egressProxyPort, egressDnsPort)
+		for _, port := range egressPorts(rules) {
+			reserved = append(reserved, int(port))
+		}
+	}
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+
+	var listeners []net.Listener
+	stop := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	for i, service := range services {
+		if service.Network == "tcp" {
+			for _, port := range reserved {
+				if port == service.Port {
+					stop()
+					return nil, fmt.Errorf("host service %s, port %d is used by the egress proxy", service.Address, port)
+				}
+			}
+			continue
+		}
+
+		socketPath := hostServiceSocketPath(containerConfig, i)
+		listener, err := listenSandboxSocket(socketPath)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+
+		if verbose {
+			fmt.Printf("Host service: %s relayed by %s\n", service.Address, socketPath)
+		}
+		go serveHostService(listener, service)
+	}
+
+	if len(listeners) == 0 {
+		return nil, nil
+	}
+	return stop, nil
+}
+
+// Listens in the container network namespace, returning the listeners in the order of the addresses
+func listenHostServices(pid int, addresses []string) ([]net.Listener, error) {
+	files, err := listenInNetns(pid, addresses)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var listeners []net.Listener
+	for _, file := range files {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Relays the TCP services from the container loopback
+func StartHostServices(conn context.Context, containerID string, containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	services, err := parseHostServices(containerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var tcpServices []HostService
+	var addresses, addresses6 []string
+	for _, service := range services {
+		if service.Network == "tcp" {
+			tcpServices = append(tcpServices, service)
+			addresses = append(addresses, fmt.Sprintf("tcp:127.0.0.1:%d", service.Port))
+			addresses6 = append(addresses6, fmt.Sprintf("tcp:[::1]:%d", service.Port))
+		}
+	}
+	if len(tcpServices) == 0 {
+		return nil, nil
+	}
+
+	pid, err := containerPid(conn, containerID)
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := listenHostServices(pid, addresses)
+	if err != nil {
+		return nil, err
+	}
+	// Without IPv6 in the container, clients can only use 127.0.0.1 anyway
+	listeners6, err := listenHostServices(pid, addresses6)
+	if err != nil {
+		fmt.Println("Host services only relayed on 127.0.0.1: ", err)
+	}
+
+	for i, service := range tcpServices {
+		if verbose {
+			fmt.Printf("Host service: %s relayed from port %d of the sandbox loopback\n", service.Address, service.Port)
+		}
+		go serveHostService(listeners[i], service)
+		if listeners6 != nil {
+			go serveHostService(listeners6[i], service)
+		}
+	}
+
+	listeners = append(listeners, listeners6...)
+	return func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}, nil
+}
@@ -0,0 +1,189 @@
+package run
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Generated machine-id, hostname and username, so sandboxes can't be correlated through the host ones. Audio
+// sandboxes always get a generated machine-id, the hostname and username are opt-in
+
+const (
+	machineIdDestination = "/etc/machine-id"
+	identityMachineId    = "machine-id"
+	identityHostname     = "hostname"
+	identityUsername     = "username"
+)
+
+// Sandboxes sharing an identity profile share the same identity. The profile names a directory of the identity
+// store, so an explicit one can't be a path, slashes of the sandbox name are replaced
+func IdentityProfile(containerConfig config.ContainerConfig) (string, error) {
+	var profile string = strings.ReplaceAll(containerConfig.Name, "/", "_")
+	if containerConfig.Run.Identity != "" {
+		profile = containerConfig.Run.Identity
+	}
+	if !filepath.IsLocal(profile) || strings.Contains(profile, "/") {
+		return "", fmt.Errorf("invalid identity profile %q, expected a name", profile)
+	}
+	return profile, nil
+}
+
+// The identity files generated for the sandbox
+func identityFiles(containerConfig config.ContainerConfig) []string {
+	if containerConfig.Run.GenerateIdentity {
+		return []string{identityMachineId, identityHostname, identityUsername}
+	}
+	if AudioMode(containerConfig) != AudioNone {
+		// The PulseAudio client identifies the machine by it
+		return []string{identityMachineId}
+	}
+	return nil
+}
+
+func identityPath(profile string, file string) string {
+	return fmt.Sprintf("%s/%s", config.GetIdentityDir(profile), file)
+}
+
+// The generated machine-id, empty when the profile is invalid
+func MachineIdPath(containerConfig config.ContainerConfig) string {
+	profile, err := IdentityProfile(containerConfig)
+	if err != nil {
+		return ""
+	}
+	return identityPath(profile, identityMachineId)
+}
+
+func randomHex(size int) (string, error) {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Returns a generated identity value, empty when not generated
+func readIdentity(containerConfig config.ContainerConfig, file string) string {
+	if !slices.Contains(identityFiles(containerConfig), file) {
+		return ""
+	}
+	profile, err := IdentityProfile(containerConfig)
+	if err != nil {
+		return ""
+	}
+	value, err := os.ReadFile(identityPath(profile, file))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// The generated hostname is set by Name, with the other hostnames
+func Identity(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if len(identityFiles(containerConfig)) == 0 {
+		return
+	}
+	if _, err := IdentityProfile(containerConfig); err != nil {
+		// PrepareIdentity aborts the launch
+		fmt.Println("Ignoring identity: ", err)
+		return
+	}
+
+	if containerConfig.Run.IdentityUser {
+		if username := readIdentity(containerConfig, identityUsername); username != "" {
+			spec.Env["USER"] = username
+			spec.Env["LOGNAME"] = username
+		}
+	}
+
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: machineIdDestination,
+		Source:      MachineIdPath(containerConfig),
+		Type:        "bind",
+		Options:     []string{"ro"},
+	})
+}
+
+// Generates the missing identity files, kept across runs until reset
+func PrepareIdentity(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	var files []string = identityFiles(containerConfig)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	profile, err := IdentityProfile(containerConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.GetIdentityDir(profile), 0755); err != nil {
+		return nil, err
+	}
+
+	generators := map[string]func() (string, error){
+		identityMachineId: func() (string, error) {
+			return randomHex(16)
+		},
+		identityHostname: func() (string, error) {
+			suffix, err := randomHex(4)
+			return "sandbox-" + suffix, err
+		},
+		identityUsername: func() (string, error) {
+			suffix, err := randomHex(3)
+			return "user" + suffix, err
+		},
+	}
+
+	for _, file := range files {
+		var path string = identityPath(profile, file)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		value, err := generators[file]()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	if verbose {
+		fmt.Println("Identity: ", config.GetIdentityDir(profile))
+	}
+
+	return nil, nil
+}
+
+// Removes the generated identity, a new one is generated on the next run
+func ResetIdentity(containerConfig config.ContainerConfig) error {
+	profile, err := IdentityProfile(containerConfig)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(config.GetIdentityDir(profile))
+}
+
+func CmdExecuteIdentityReset(verbose bool, args []string) {
+	var container_name string = args[0]
+	var containerConfig config.ContainerConfig = config.LoadConfig(container_name)
+
+	if err := ResetIdentity(containerConfig); err != nil {
+		fmt.Println("Failed to reset identity")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+
+	if verbose {
+		profile, _ := IdentityProfile(containerConfig)
+		fmt.Println("Removed: ", config.GetIdentityDir(profile))
+	}
+	fmt.Printf("Identity of %s reset, a new one is generated on the next run\n", container_name)
+}
@@ -0,0 +1,46 @@
+package run
+
+import (
+	"net"
+	"os"
+)
+
+// Unix sockets served from the host and mounted in the sandbox. Sandbox users may be mapped to other uids, so
+// the sockets are writable by everyone, the sandbox runtime directory they are created in is private to the user.
+
+// Listens on a unix socket at path, replacing a stale one
+func listenSandboxSocket(path string) (*net.UnixListener, error) {
+	os.Remove(path)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0777); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Handles every client in its own goroutine, until the listener is closed
+func serveListener(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// Serves the clients of a new sandbox socket, the returned function closes it
+func startSandboxSocket(path string, handle func(net.Conn)) (func(), error) {
+	listener, err := listenSandboxSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	go serveListener(listener, handle)
+	return func() {
+		listener.Close()
+	}, nil
+}
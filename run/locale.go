@@ -0,0 +1,20 @@
+package run
+
+import (
+	"os"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+)
+
+func Locale(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.Locale {
+		passEnv(spec, "LANG", "LANGUAGE")
+		for _, env := range os.Environ() {
+			if k, v, found := strings.Cut(env, "="); found && strings.HasPrefix(k, "LC_") {
+				spec.Env[k] = v
+			}
+		}
+	}
+}
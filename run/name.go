@@ -5,9 +5,16 @@ import (
 	"github.com/julioln/sandman/config"
 )
 
+// The hostname is, in order of precedence, Hostname, Name, then the generated identity hostname
 func Name(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if hostname := readIdentity(containerConfig, identityHostname); hostname != "" {
+		spec.Hostname = hostname
+	}
 	if containerConfig.Run.Name != "" {
 		spec.Name = containerConfig.Run.Name
 		spec.Hostname = containerConfig.Run.Name
 	}
+	if containerConfig.Run.Hostname != "" {
+		spec.Hostname = containerConfig.Run.Hostname
+	}
 }
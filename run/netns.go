@@ -0,0 +1,172 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/bindings/containers"
+	"golang.org/x/sys/unix"
+)
+
+// Sockets are created in the network namespace of the container, but served from the host. nsenter joins
+// the namespaces from a single threaded process (rootless podman needs its user namespace too) and runs a
+// hidden sandman command that hands the sockets back, they keep the namespace they were created in.
+
+const (
+	NetnsListenCommand = "netns-listen"
+
+	// The socket back to the host, the first of the extra files
+	netnsHelperFd   = 3
+	netnsMaxSockets = 64
+)
+
+func containerPid(conn context.Context, containerID string) (int, error) {
+	containerData, err := containers.Inspect(conn, containerID, new(containers.InspectOptions))
+	if err != nil {
+		return 0, err
+	}
+	if containerData.State == nil || containerData.State.Pid == 0 {
+		return 0, fmt.Errorf("container is not initialized")
+	}
+	return containerData.State.Pid, nil
+}
+
+// Listens on network:address entries (tcp or udp) in the network namespace of the process
+func listenInNetns(pid int, addresses []string) ([]*os.File, error) {
+	if len(addresses) > netnsMaxSockets {
+		return nil, fmt.Errorf("too many sockets in the container network namespace: %d", len(addresses))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string = []string{"--target", strconv.Itoa(pid), "--net"}
+	hostUserNS, _ := os.Readlink("/proc/self/ns/user")
+	containerUserNS, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/user", pid))
+	if err != nil {
+		return nil, err
+	}
+	if hostUserNS != containerUserNS {
+		args = append(args, "--user")
+	}
+	args = append(args, "--", executable, NetnsListenCommand)
+	args = append(args, addresses...)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "netns")
+	remote := os.NewFile(uintptr(fds[1]), "netns")
+	defer local.Close()
+
+	cmd := exec.Command("nsenter", args...)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		remote.Close()
+		return nil, fmt.Errorf("failed to enter the container network namespace: %w", err)
+	}
+	remote.Close()
+
+	buffer := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(netnsMaxSockets*4))
+	_, oobn, _, _, recvErr := unix.Recvmsg(int(local.Fd()), buffer, oob, 0)
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to listen in the container network namespace: %w", err)
+	}
+	if recvErr != nil {
+		return nil, recvErr
+	}
+
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) != 1 {
+		return nil, fmt.Errorf("no sockets received from the container network namespace")
+	}
+	received, err := unix.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	for _, fd := range received {
+		unix.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "netns"))
+	}
+	if len(files) != len(addresses) {
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, fmt.Errorf("expected %d sockets from the container network namespace, got %d", len(addresses), len(files))
+	}
+	return files, nil
+}
+
+func netnsSocket(address string) (*os.File, error) {
+	network, hostPort, _ := strings.Cut(address, ":")
+	switch network {
+	case "tcp":
+		listener, err := net.Listen(network, hostPort)
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+		return listener.(*net.TCPListener).File()
+	case "udp":
+		conn, err := net.ListenPacket(network, hostPort)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.(*net.UDPConn).File()
+	}
+	return nil, fmt.Errorf("invalid socket %s, expected tcp or udp", address)
+}
+
+// Runs in the container network namespace, sends the sockets to the host
+func CmdExecuteNetnsListen(args []string) {
+	var fds []int
+	for _, address := range args {
+		file, err := netnsSocket(address)
+		if err != nil {
+			fmt.Println("Failed to listen in the container network namespace")
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		fds = append(fds, int(file.Fd()))
+	}
+
+	if err := unix.Sendmsg(netnsHelperFd, []byte{0}, unix.UnixRights(fds...), nil, 0); err != nil {
+		fmt.Println("Failed to send sockets to the host")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
+}
+
+// Copies both directions until either side is done
+func relayConns(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
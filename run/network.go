@@ -1,26 +1,181 @@
 package run
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strings"
 
+	"github.com/containers/podman/v6/pkg/bindings/network"
 	"github.com/containers/podman/v6/pkg/specgen"
 	"github.com/julioln/sandman/config"
+	"go.podman.io/common/libnetwork/types"
 )
 
-func Network(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
-	// Configure network namespace
+// Returns the network namespace and the networks it joins
+func parseNetwork(containerConfig config.ContainerConfig) (specgen.Namespace, map[string]types.PerNetworkOptions, error) {
 	var networkNS specgen.Namespace
-	if containerConfig.Run.Network == "" && !containerConfig.Run.Net {
+	if len(containerConfig.Run.Egress) > 0 {
+		// Only loopback, sandman serves the allowlist in the namespace
+		networkNS.NSMode = specgen.None
+	} else if containerConfig.Run.Network == "" && !containerConfig.Run.Net {
 		networkNS.NSMode = specgen.None
 	} else if containerConfig.Run.Net {
 		// Backwards compatibility
 		networkNS.NSMode = specgen.Slirp
 	} else {
+		var networks map[string]types.PerNetworkOptions
 		var err error
-		if networkNS, _, _, err = specgen.ParseNetworkFlag([]string{containerConfig.Run.Network}); err != nil {
-			fmt.Println("Error parsing network, defaulting to none: ", err)
-			networkNS.NSMode = specgen.None
+		if networkNS, networks, _, err = specgen.ParseNetworkFlag([]string{containerConfig.Run.Network}); err != nil {
+			return networkNS, nil, fmt.Errorf("invalid Network %s: %w", containerConfig.Run.Network, err)
+		}
+		return networkNS, networks, nil
+	}
+	return networkNS, nil, nil
+}
+
+// Host entries are host:ip, as in podman --add-host
+func parseExtraHost(entry string) error {
+	host, ip, found := strings.Cut(entry, ":")
+	if !found || host == "" || (net.ParseIP(ip) == nil && ip != "host-gateway") {
+		return fmt.Errorf("invalid ExtraHosts %s, expected host:ip", entry)
+	}
+	return nil
+}
+
+func validateNetwork(containerConfig config.ContainerConfig) error {
+	networkNS, networks, err := parseNetwork(containerConfig)
+	if err != nil {
+		return err
+	}
+	var isolated bool = networkNS.NSMode == specgen.None || networkNS.NSMode == specgen.Host
+
+	for _, server := range containerConfig.Run.Dns {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid Dns %s, expected an IP", server)
+		}
+	}
+	if isolated && (len(containerConfig.Run.Dns) > 0 || len(containerConfig.Run.DnsSearch) > 0) {
+		return fmt.Errorf("Dns and DnsSearch need a network, not %s", networkNS.NSMode)
+	}
+
+	for _, host := range containerConfig.Run.ExtraHosts {
+		if err := parseExtraHost(host); err != nil {
+			return err
+		}
+	}
+
+	if containerConfig.Run.StaticIP != "" {
+		if net.ParseIP(containerConfig.Run.StaticIP) == nil {
+			return fmt.Errorf("invalid StaticIP %s", containerConfig.Run.StaticIP)
+		}
+		if networkNS.NSMode != specgen.Bridge || len(networks) != 1 {
+			return fmt.Errorf("StaticIP needs a single named Network")
+		}
+	}
+
+	var names []string
+	for _, n := range containerConfig.Run.Networks {
+		if _, err := managedNetwork(n); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if name == n.Name {
+				return fmt.Errorf("network %s is declared twice", n.Name)
+			}
+		}
+		names = append(names, n.Name)
+	}
+	return nil
+}
+
+func managedNetwork(n config.ContainerConfigRunNetwork) (types.Network, error) {
+	var managed types.Network = types.Network{
+		Name:     n.Name,
+		Driver:   "bridge",
+		Internal: n.Internal,
+	}
+	if n.Name == "" {
+		return managed, fmt.Errorf("networks need a name")
+	}
+	if n.Subnet != "" {
+		subnet, err := types.ParseCIDR(n.Subnet)
+		if err != nil {
+			return managed, fmt.Errorf("invalid subnet %s of network %s: %w", n.Subnet, n.Name, err)
 		}
+		managed.Subnets = append(managed.Subnets, types.Subnet{Subnet: subnet})
+	}
+	return managed, nil
+}
+
+// Creates the declared networks that don't exist yet, existing ones are left as they are. Nothing is created
+// for an invalid network configuration
+func CreateNetworks(conn context.Context, containerConfig config.ContainerConfig, verbose bool) error {
+	if err := validateNetwork(containerConfig); err != nil {
+		return err
+	}
+
+	for _, n := range containerConfig.Run.Networks {
+		managed, err := managedNetwork(n)
+		if err != nil {
+			return err
+		}
+
+		exists, err := network.Exists(conn, n.Name, nil)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if _, err := network.Create(conn, &managed); err != nil {
+			return fmt.Errorf("failed to create network %s: %w", n.Name, err)
+		}
+		if verbose {
+			fmt.Printf("Created network %s (%#v)\n", n.Name, managed)
+		}
+	}
+	return nil
+}
+
+func Network(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	// Configure network namespace
+	networkNS, networks, err := parseNetwork(containerConfig)
+	if err != nil {
+		// PrepareNetwork aborts the launch, the spec stays offline
+		fmt.Println("Ignoring network: ", err)
+		networkNS.NSMode = specgen.None
+		networks = nil
 	}
 	spec.NetNS = networkNS
+
+	if ip := net.ParseIP(containerConfig.Run.StaticIP); ip != nil && len(networks) == 1 {
+		for name, options := range networks {
+			options.StaticIPs = append(options.StaticIPs, ip)
+			networks[name] = options
+		}
+	}
+	if len(networks) > 0 {
+		spec.Networks = networks
+	}
+
+	for _, server := range containerConfig.Run.Dns {
+		if ip := net.ParseIP(server); ip != nil {
+			spec.DNSServers = append(spec.DNSServers, ip)
+		}
+	}
+	spec.DNSSearch = append(spec.DNSSearch, containerConfig.Run.DnsSearch...)
+
+	for _, host := range containerConfig.Run.ExtraHosts {
+		if err := parseExtraHost(host); err != nil {
+			fmt.Println("Ignoring host: ", err)
+			continue
+		}
+		spec.HostAdd = append(spec.HostAdd, host)
+	}
+}
+
+func PrepareNetwork(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	return nil, validateNetwork(containerConfig)
 }
@@ -0,0 +1,15 @@
+package run
+
+import (
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+)
+
+const notificationsBusName = "org.freedesktop.Notifications"
+
+func Notifications(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	// Only the notifications service is reachable, unless full D-Bus access is enabled
+	if containerConfig.Run.Notifications {
+		mountSessionBus(spec, containerConfig)
+	}
+}
@@ -0,0 +1,185 @@
+package run
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	openOnHostSocketDestination = "/tmp/.sandman-open"
+	openOnHostShimDestination   = "/usr/local/bin/xdg-open"
+	openOnHostMaxURLSize        = 8192
+)
+
+var openOnHostDefaultSchemes = []string{"http", "https", "mailto"}
+
+// Forwards the URL to the host listener
+var openOnHostShim = shimHeader(openOnHostSocketDestination) + `
+if [ $# -ne 1 ]; then
+	echo "Usage: xdg-open { file | URL }" >&2
+	exit 1
+fi
+
+reply=$(printf '%s\n' "$1" | send)
+if [ "$reply" = "ok" ]; then
+	exit 0
+fi
+echo "xdg-open: $reply" >&2
+exit 1
+`
+
+func OpenOnHostSocketPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/open", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
+func OpenOnHostShimPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/xdg-open", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
+func openOnHostSchemes(containerConfig config.ContainerConfig) []string {
+	if len(containerConfig.Run.OpenOnHostSchemes) > 0 {
+		return containerConfig.Run.OpenOnHostSchemes
+	}
+	return openOnHostDefaultSchemes
+}
+
+// Only absolute URLs with an allowed scheme, paths in the sandbox mean nothing on the host
+func OpenOnHostAllowed(rawURL string, schemes []string) error {
+	if len(rawURL) > openOnHostMaxURLSize {
+		return fmt.Errorf("URL too long")
+	}
+	for _, c := range rawURL {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("invalid character in URL")
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL")
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("not a URL, files can't be opened on the host")
+	}
+	if !slices.Contains(schemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("scheme %s is not allowed", u.Scheme)
+	}
+	return nil
+}
+
+// Asks through a dialog on the host, refusing when no dialog tool is available
+func openOnHostConfirm(containerConfig config.ContainerConfig, rawURL string) bool {
+	var text string = fmt.Sprintf("%s wants to open:\n%s", containerConfig.Name, rawURL)
+	if _, err := exec.LookPath("zenity"); err == nil {
+		return exec.Command("zenity", "--question", "--title=sandman", "--no-markup", "--text", text).Run() == nil
+	}
+	if _, err := exec.LookPath("kdialog"); err == nil {
+		return exec.Command("kdialog", "--title", "sandman", "--yesno", text).Run() == nil
+	}
+	fmt.Println("No zenity or kdialog to confirm opening: ", rawURL)
+	return false
+}
+
+func openOnHostXdgOpen(rawURL string) error {
+	// The opened application outlives the sandbox
+	cmd := exec.Command("xdg-open", rawURL)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+func handleOpenOnHost(conn net.Conn, allowed func(string) error, open func(string) error) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, openOnHostMaxURLSize+1)
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		fmt.Fprintln(conn, "refused: URL too long")
+		return
+	}
+	if err != nil && len(line) == 0 {
+		return
+	}
+	var rawURL string = strings.TrimSuffix(string(line), "\n")
+
+	if err := allowed(rawURL); err != nil {
+		fmt.Printf("Refused to open %q: %s\n", rawURL, err)
+		fmt.Fprintf(conn, "refused: %s\n", err)
+		return
+	}
+	if err := open(rawURL); err != nil {
+		fmt.Fprintf(conn, "failed: %s\n", err)
+		return
+	}
+	fmt.Fprintln(conn, "ok")
+}
+
+// Listens on listenPath for URLs, calling open for the allowed ones
+func StartOpenOnHost(listenPath string, allowed func(string) error, open func(string) error) (func(), error) {
+	return startSandboxSocket(listenPath, func(conn net.Conn) {
+		handleOpenOnHost(conn, allowed, open)
+	})
+}
+
+func OpenOnHost(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.OpenOnHost {
+		spec.Env["BROWSER"] = "xdg-open"
+		spec.Mounts = append(spec.Mounts,
+			specs.Mount{
+				Destination: openOnHostSocketDestination,
+				Source:      OpenOnHostSocketPath(containerConfig),
+				Type:        "bind",
+			},
+			specs.Mount{
+				Destination: openOnHostShimDestination,
+				Source:      OpenOnHostShimPath(containerConfig),
+				Type:        "bind",
+				Options:     []string{"ro"},
+			},
+		)
+	}
+}
+
+func PrepareOpenOnHost(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if !containerConfig.Run.OpenOnHost {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(OpenOnHostShimPath(containerConfig), []byte(openOnHostShim), 0755); err != nil {
+		return nil, err
+	}
+
+	var schemes []string = openOnHostSchemes(containerConfig)
+	allowed := func(rawURL string) error {
+		if err := OpenOnHostAllowed(rawURL, schemes); err != nil {
+			return err
+		}
+		if containerConfig.Run.OpenOnHostPrompt && !openOnHostConfirm(containerConfig, rawURL) {
+			return fmt.Errorf("not confirmed")
+		}
+		return nil
+	}
+	open := func(rawURL string) error {
+		if verbose {
+			fmt.Println("Opening on host: ", rawURL)
+		}
+		return openOnHostXdgOpen(rawURL)
+	}
+
+	return StartOpenOnHost(OpenOnHostSocketPath(containerConfig), allowed, open)
+}
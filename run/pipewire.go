@@ -10,12 +10,14 @@ import (
 )
 
 func Pipewire(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
-	if containerConfig.Run.Pipewire {
+	if audioPipewire(containerConfig) {
+		var socket string = fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR"))
 		spec.Env["XDG_RUNTIME_DIR"] = os.Getenv("XDG_RUNTIME_DIR")
+		spec.Env["PIPEWIRE_REMOTE"] = socket
 		spec.Mounts = append(spec.Mounts,
 			specs.Mount{
-				Destination: fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR")),
-				Source:      fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR")),
+				Destination: socket,
+				Source:      socket,
 				Type:        "bind",
 			},
 		)
@@ -0,0 +1,37 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const portalsBusName = "org.freedesktop.portal.*"
+
+func Portals(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.Portals {
+		mountSessionBus(spec, containerConfig)
+		spec.Env["GTK_USE_PORTAL"] = "1"
+
+		// Files picked through the file chooser are exposed by the document portal, only those granted to the
+		// sandbox, with the name as the app id
+		var documents string = fmt.Sprintf("%s/doc", os.Getenv("XDG_RUNTIME_DIR"))
+		if !filepath.IsLocal(containerConfig.Name) || strings.Contains(containerConfig.Name, "/") {
+			fmt.Println("Ignoring the document portal, the name is not a valid app id: ", containerConfig.Name)
+			return
+		}
+		var appDocuments string = filepath.Join(documents, "by-app", containerConfig.Name)
+		if _, err := os.Stat(appDocuments); err == nil {
+			spec.Mounts = append(spec.Mounts, specs.Mount{
+				Destination: documents,
+				Source:      appDocuments,
+				Type:        "bind",
+			})
+		}
+	}
+}
@@ -2,6 +2,8 @@ package run
 
 import (
 	"fmt"
+	"net"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -10,20 +12,108 @@ import (
 	"go.podman.io/common/libnetwork/types"
 )
 
+const defaultPortHostIP = "127.0.0.1"
+
+var portProtocols = []string{"tcp", "udp", "sctp"}
+
+// Parses port or start-end, returning the first port and the range size
+func parsePortRange(ports string) (uint16, uint16, error) {
+	start, end, isRange := strings.Cut(ports, "-")
+	first, err := strconv.ParseUint(start, 10, 16)
+	if err != nil || first == 0 {
+		return 0, 0, fmt.Errorf("invalid port %s", start)
+	}
+	if !isRange {
+		return uint16(first), 1, nil
+	}
+
+	last, err := strconv.ParseUint(end, 10, 16)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid port range %s", ports)
+	}
+	return uint16(first), uint16(last - first + 1), nil
+}
+
+// Parses [hostIP:]hostPort[-end]:containerPort[-end][/tcp|udp|sctp]. Entries with neither a host IP nor a
+// protocol and different ports are reported as ambiguous, as sandman used to read them container first.
+func ParsePortMapping(entry string) (types.PortMapping, bool, error) {
+	var mapping types.PortMapping
+	var explicit bool
+
+	ports, protocol, hasProtocol := strings.Cut(entry, "/")
+	mapping.Protocol = "tcp"
+	if hasProtocol {
+		if !slices.Contains(portProtocols, protocol) {
+			return mapping, false, fmt.Errorf("invalid port %s, unknown protocol %s", entry, protocol)
+		}
+		mapping.Protocol = protocol
+		explicit = true
+	}
+
+	// The host IP may be IPv6, e.g. [::1]:8080:80
+	mapping.HostIP = defaultPortHostIP
+	if i := strings.LastIndex(ports, ":"); i >= 0 {
+		if j := strings.LastIndex(ports[:i], ":"); j >= 0 {
+			hostIP := strings.TrimSuffix(strings.TrimPrefix(ports[:j], "["), "]")
+			if net.ParseIP(hostIP) == nil {
+				return mapping, false, fmt.Errorf("invalid port %s, invalid host IP %s", entry, hostIP)
+			}
+			mapping.HostIP = hostIP
+			ports = ports[j+1:]
+			explicit = true
+		}
+	}
+
+	hostPorts, containerPorts, found := strings.Cut(ports, ":")
+	if !found {
+		return mapping, false, fmt.Errorf("invalid port %s, expected [hostIP:]hostPort:containerPort[/protocol]", entry)
+	}
+
+	hostPort, hostRange, err := parsePortRange(hostPorts)
+	if err != nil {
+		return mapping, false, fmt.Errorf("invalid port %s: %w", entry, err)
+	}
+	containerPort, containerRange, err := parsePortRange(containerPorts)
+	if err != nil {
+		return mapping, false, fmt.Errorf("invalid port %s: %w", entry, err)
+	}
+	if hostRange != containerRange {
+		return mapping, false, fmt.Errorf("invalid port %s, host and container ranges differ in size", entry)
+	}
+
+	mapping.HostPort = hostPort
+	mapping.ContainerPort = containerPort
+	if containerRange > 1 {
+		mapping.Range = containerRange
+	}
+
+	return mapping, !explicit && hostPort != containerPort, nil
+}
+
 func Ports(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	for _, ports := range containerConfig.Run.Ports {
-		p := strings.Split(ports, ":")
-		if len(p) < 2 {
-			fmt.Println("Invalid port configuration, ignoring: ", p)
+		mapping, _, err := ParsePortMapping(ports)
+		if err != nil {
+			fmt.Println("Invalid port configuration, ignoring: ", err)
 			continue
 		}
 
-		containerPort, _ := strconv.Atoi(p[0])
-		hostPort, _ := strconv.Atoi(p[1])
+		spec.PortMappings = append(spec.PortMappings, mapping)
+	}
+}
 
-		spec.PortMappings = append(spec.PortMappings, types.PortMapping{
-			ContainerPort: uint16(containerPort),
-			HostPort:      uint16(hostPort),
-		})
+// Invalid ports abort the launch
+func PreparePorts(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	for _, ports := range containerConfig.Run.Ports {
+		mapping, ambiguous, err := ParsePortMapping(ports)
+		if err != nil {
+			return nil, err
+		}
+		if ambiguous {
+			fmt.Printf("Port %s maps host port %d to container port %d. Older versions read it the other way around,"+
+				" swap them if needed. Add the host IP or protocol (e.g. %s:%s/tcp) to silence this warning.\n",
+				ports, mapping.HostPort, mapping.ContainerPort, defaultPortHostIP, ports)
+		}
 	}
+	return nil, nil
 }
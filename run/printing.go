@@ -0,0 +1,42 @@
+package run
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const cupsSocket = "/run/cups/cups.sock"
+
+// The host scheduler socket, mounted at cupsSocket
+var cupsHostSocket = cupsSocket
+
+func Printing(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	// Only the local CUPS socket, printers are reached through the host scheduler
+	if containerConfig.Run.Printing {
+		if _, err := os.Stat(cupsHostSocket); err != nil {
+			return
+		}
+
+		spec.Env["CUPS_SERVER"] = cupsSocket
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: cupsSocket,
+			Source:      cupsHostSocket,
+			Type:        "bind",
+		})
+	}
+}
+
+// Warns about a missing scheduler, the sandbox just has no printers without one
+func PreparePrinting(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if !containerConfig.Run.Printing {
+		return nil, nil
+	}
+	if _, err := os.Stat(cupsHostSocket); err != nil {
+		fmt.Println("Warning: printing unavailable, no CUPS socket: ", err)
+	}
+	return nil, nil
+}
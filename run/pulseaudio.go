@@ -9,21 +9,68 @@ import (
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+const (
+	pulseCookieDestination       = "/tmp/.sandman-pulse-cookie"
+	pulseClientConfigDestination = "/tmp/.sandman-pulse-client.conf"
+)
+
+func pulseSocketPath() string {
+	return fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR"))
+}
+
+func pulseCookiePath() string {
+	if cookie, exists := os.LookupEnv("PULSE_COOKIE"); exists {
+		return cookie
+	}
+	if configHome, exists := os.LookupEnv("XDG_CONFIG_HOME"); exists {
+		return fmt.Sprintf("%s/pulse/cookie", configHome)
+	}
+	home, _ := os.UserHomeDir()
+	return fmt.Sprintf("%s/.config/pulse/cookie", home)
+}
+
+func PulseProxyPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/pulse", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
+func PulseClientConfigPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/pulse-client.conf", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
 func Pulseaudio(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
-	if containerConfig.Run.Pulseaudio {
-		spec.Env["XDG_RUNTIME_DIR"] = os.Getenv("XDG_RUNTIME_DIR")
-		spec.Mounts = append(spec.Mounts,
-			specs.Mount{
-				Destination: "/etc/machine-id",
-				Source:      "/etc/machine-id",
+	if audioPulse(containerConfig) {
+		var socket string = pulseSocketPath()
+		var source string = socket
+		if containerConfig.Run.AudioPlaybackOnly {
+			source = PulseProxyPath(containerConfig)
+			spec.Env["PULSE_CLIENTCONFIG"] = pulseClientConfigDestination
+			spec.Mounts = append(spec.Mounts, specs.Mount{
+				Destination: pulseClientConfigDestination,
+				Source:      PulseClientConfigPath(containerConfig),
 				Type:        "bind",
 				Options:     []string{"ro"},
-			},
+			})
+		}
+
+		spec.Env["XDG_RUNTIME_DIR"] = os.Getenv("XDG_RUNTIME_DIR")
+		spec.Env["PULSE_SERVER"] = fmt.Sprintf("unix:%s", socket)
+		spec.Mounts = append(spec.Mounts,
 			specs.Mount{
-				Destination: fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
-				Source:      fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
+				Destination: socket,
+				Source:      source,
 				Type:        "bind",
 			},
 		)
+
+		// Needed when the server requires authentication
+		if _, err := os.Stat(pulseCookiePath()); err == nil {
+			spec.Env["PULSE_COOKIE"] = pulseCookieDestination
+			spec.Mounts = append(spec.Mounts, specs.Mount{
+				Destination: pulseCookieDestination,
+				Source:      pulseCookiePath(),
+				Type:        "bind",
+				Options:     []string{"ro"},
+			})
+		}
 	}
 }
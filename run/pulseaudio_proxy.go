@@ -0,0 +1,179 @@
+package run
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// PulseAudio native protocol proxy that refuses record streams, so the sandbox can only play audio
+
+const (
+	pulseDescriptorSize = 20
+	pulseMaxPacketSize  = 16 * 1024 * 1024
+	pulseControlChannel = 0xffffffff
+	pulseTagU32         = 'L'
+
+	pulseCommandError = 0
+	pulseErrorAccess  = 1
+)
+
+// Commands a playback client needs, anything else is refused: recording, modules, moving streams, changing
+// devices, ports, profiles, defaults or other clients
+var pulsePlaybackCommands = map[uint32]bool{
+	3:  true, // CREATE_PLAYBACK_STREAM
+	4:  true, // DELETE_PLAYBACK_STREAM
+	8:  true, // AUTH
+	9:  true, // SET_CLIENT_NAME
+	10: true, // LOOKUP_SINK
+	12: true, // DRAIN_PLAYBACK_STREAM
+	13: true, // STAT
+	14: true, // GET_PLAYBACK_LATENCY
+	15: true, // CREATE_UPLOAD_STREAM
+	16: true, // DELETE_UPLOAD_STREAM
+	17: true, // FINISH_UPLOAD_STREAM
+	18: true, // PLAY_SAMPLE
+	19: true, // REMOVE_SAMPLE
+	20: true, // GET_SERVER_INFO
+	21: true, // GET_SINK_INFO
+	22: true, // GET_SINK_INFO_LIST
+	29: true, // GET_SINK_INPUT_INFO
+	30: true, // GET_SINK_INPUT_INFO_LIST
+	33: true, // GET_SAMPLE_INFO
+	34: true, // GET_SAMPLE_INFO_LIST
+	35: true, // SUBSCRIBE
+	37: true, // SET_SINK_INPUT_VOLUME
+	41: true, // CORK_PLAYBACK_STREAM
+	42: true, // FLUSH_PLAYBACK_STREAM
+	43: true, // TRIGGER_PLAYBACK_STREAM
+	46: true, // SET_PLAYBACK_STREAM_NAME
+	60: true, // PREBUF_PLAYBACK_STREAM
+	69: true, // SET_SINK_INPUT_MUTE
+	72: true, // SET_PLAYBACK_STREAM_BUFFER_ATTR
+	74: true, // UPDATE_PLAYBACK_STREAM_SAMPLE_RATE
+	81: true, // UPDATE_PLAYBACK_STREAM_PROPLIST
+	82: true, // UPDATE_CLIENT_PROPLIST
+	84: true, // REMOVE_PLAYBACK_STREAM_PROPLIST
+	85: true, // REMOVE_CLIENT_PROPLIST
+	88: true, // GET_CARD_INFO
+	89: true, // GET_CARD_INFO_LIST
+}
+
+type pulsePacket struct {
+	descriptor []byte
+	payload    []byte
+}
+
+func readPulsePacket(r io.Reader) (pulsePacket, error) {
+	var packet pulsePacket
+	packet.descriptor = make([]byte, pulseDescriptorSize)
+	if _, err := io.ReadFull(r, packet.descriptor); err != nil {
+		return packet, err
+	}
+
+	length := binary.BigEndian.Uint32(packet.descriptor)
+	if length > pulseMaxPacketSize {
+		return packet, fmt.Errorf("pulseaudio packet too large: %d", length)
+	}
+
+	packet.payload = make([]byte, length)
+	_, err := io.ReadFull(r, packet.payload)
+	return packet, err
+}
+
+// Commands are sent on the control channel, streams on their own
+func (packet pulsePacket) control() bool {
+	return binary.BigEndian.Uint32(packet.descriptor[4:]) == pulseControlChannel
+}
+
+// Returns the command and tag of a control packet
+func (packet pulsePacket) command() (uint32, uint32, bool) {
+	if !packet.control() {
+		return 0, 0, false
+	}
+	if len(packet.payload) < 10 || packet.payload[0] != pulseTagU32 || packet.payload[5] != pulseTagU32 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(packet.payload[1:]), binary.BigEndian.Uint32(packet.payload[6:]), true
+}
+
+func pulseErrorPacket(tag uint32, code uint32) []byte {
+	var payload []byte
+	for _, v := range []uint32{pulseCommandError, tag, code} {
+		payload = append(payload, pulseTagU32)
+		payload = binary.BigEndian.AppendUint32(payload, v)
+	}
+
+	descriptor := make([]byte, pulseDescriptorSize)
+	binary.BigEndian.PutUint32(descriptor, uint32(len(payload)))
+	binary.BigEndian.PutUint32(descriptor[4:], pulseControlChannel)
+	return append(descriptor, payload...)
+}
+
+func proxyPulseClient(client net.Conn, serverSocket string) {
+	defer client.Close()
+
+	server, err := net.Dial("unix", serverSocket)
+	if err != nil {
+		fmt.Println("PulseAudio proxy can't connect to the server: ", err)
+		return
+	}
+	defer server.Close()
+
+	// Both directions write to the client, so whole packets are written under the lock
+	var clientLock sync.Mutex
+	writeClient := func(data []byte) error {
+		clientLock.Lock()
+		defer clientLock.Unlock()
+		_, err := client.Write(data)
+		return err
+	}
+
+	go func() {
+		defer client.Close()
+		defer server.Close()
+		for {
+			packet, err := readPulsePacket(server)
+			if err != nil {
+				return
+			}
+			if err := writeClient(append(packet.descriptor, packet.payload...)); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		packet, err := readPulsePacket(client)
+		if err != nil {
+			return
+		}
+
+		if packet.control() {
+			command, tag, ok := packet.command()
+			if !ok {
+				// Can't be checked, so can't be forwarded
+				return
+			}
+			if !pulsePlaybackCommands[command] {
+				if err := writeClient(pulseErrorPacket(tag, pulseErrorAccess)); err != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		if _, err := server.Write(append(packet.descriptor, packet.payload...)); err != nil {
+			return
+		}
+	}
+}
+
+// Forwards the clients on listenPath to the server socket, for playback only
+func StartPulseProxy(serverSocket string, listenPath string) (func(), error) {
+	return startSandboxSocket(listenPath, func(client net.Conn) {
+		proxyPulseClient(client, serverSocket)
+	})
+}
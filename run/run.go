@@ -17,30 +17,143 @@ import (
 
 var (
 	configFunctions = []func(spec *specgen.SpecGenerator, config config.ContainerConfig){
+		Accessibility,
+		Camera,
+		Clipboard,
 		Dbus,
 		Devices,
+		Egress,
 		Env,
 		Fonts,
+		Gamepad,
+		GpgAgent,
 		Gpu,
 		Home,
+		HostServices,
+		Identity,
 		Ipc,
 		Limits,
+		Locale,
 		Name,
 		Network,
+		Notifications,
+		OpenOnHost,
 		Pipewire,
+		Portals,
 		Ports,
+		Printing,
 		Pulseaudio,
 		Raw,
+		Scanning,
+		SshAgent,
+		Theme,
+		Timezone,
 		Uidmap,
 		Usb,
 		Volumes,
 		Wayland,
 		X11,
 	}
+
+	// Host side setup before the container is created. The returned function, if any, tears down
+	// helpers that must live as long as the container
+	prepareFunctions = []func(config config.ContainerConfig, verbose bool) (func(), error){
+		PrepareAudio,
+		PrepareClipboard,
+		PrepareDbus,
+		PrepareDevices,
+		PrepareEgress,
+		PrepareGpu,
+		PrepareHostServices,
+		PrepareIdentity,
+		PrepareNetwork,
+		PrepareOpenOnHost,
+		PreparePorts,
+		PreparePrinting,
+		PrepareSshAgent,
+		PrepareUsbHotplug,
+		PrepareWayland,
+		PrepareX11,
+	}
+
+	// Host side helpers that need the container namespaces, up before its entrypoint runs. Stopped the same way
+	startedFunctions = []func(conn context.Context, containerID string, config config.ContainerConfig, verbose bool) (func(), error){
+		StartEgress,
+		StartHostServices,
+		StartUsbHotplug,
+	}
 )
 
-func Start(socket string, containerConfig config.ContainerConfig, attach bool, keep bool, verbose bool, runCmd []string) {
+// Runs the hooks in order, combining their cleanups. Nothing is left running on failure
+func runHooks(hooks []func(config config.ContainerConfig, verbose bool) (func(), error), containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	for _, f := range hooks {
+		c, err := f(containerConfig, verbose)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		if c != nil {
+			cleanups = append(cleanups, c)
+		}
+	}
+
+	if len(cleanups) == 0 {
+		return nil, nil
+	}
+	return cleanup, nil
+}
+
+func Prepare(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	return runHooks(prepareFunctions, containerConfig, verbose)
+}
+
+func Started(conn context.Context, containerID string, containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	var hooks []func(config config.ContainerConfig, verbose bool) (func(), error)
+	for _, f := range startedFunctions {
+		hooks = append(hooks, func(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+			return f(conn, containerID, containerConfig, verbose)
+		})
+	}
+	return runHooks(hooks, containerConfig, verbose)
+}
+
+// Failures return through the deferred cleanups, so nothing prepared for the sandbox is left behind
+func Start(socket string, containerConfig config.ContainerConfig, attach bool, keep bool, verbose bool, runCmd []string) (err error) {
 	var conn context.Context = podman.InitializePodman(socket)
+
+	if err := CreateNetworks(conn, containerConfig, verbose); err != nil {
+		return fmt.Errorf("failed to create networks: %w", err)
+	}
+
+	// The spec reads what is generated here, such as the identity
+	var cleanup func()
+	output := captureOutput(func() {
+		cleanup, err = Prepare(containerConfig, verbose)
+	})
+
+	// Started sandboxes keeping helpers are handed to a detached copy, which prepares them again
+	if !attach && detachedReadyFile == nil && err == nil && (cleanup != nil || startedHelpers(containerConfig)) {
+		if cleanup != nil {
+			cleanup()
+		}
+		os.Exit(startDetached(containerConfig))
+	}
+	os.Stdout.Write(output)
+
+	if err != nil {
+		return fmt.Errorf("failed to prepare sandbox: %w", err)
+	}
+	if cleanup != nil {
+		defer cleanup()
+	}
+
 	var spec = CreateSpec(containerConfig)
 
 	// Check overrides
@@ -60,25 +173,42 @@ func Start(socket string, containerConfig config.ContainerConfig, attach bool, k
 	var createOptions containers.CreateOptions
 	container, err := containers.CreateWithSpec(conn, spec, &createOptions)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create container: %w", err)
 	}
+	defer func() {
+		// Never left running without its helpers
+		if err != nil {
+			containers.Remove(conn, container.ID, new(containers.RemoveOptions).WithForce(true))
+		}
+	}()
 
 	if verbose {
 		fmt.Printf("Container: %#v\n", container)
 	}
 
+	// Initialized without running the entrypoint, so it never sees the helpers missing
+	if err = containers.ContainerInit(conn, container.ID, nil); err != nil {
+		return fmt.Errorf("failed to initialize container: %w", err)
+	}
+
+	stop, err := Started(conn, container.ID, containerConfig, verbose)
+	if err != nil {
+		return fmt.Errorf("failed to start sandbox helpers: %w", err)
+	}
+	if stop != nil {
+		defer stop()
+	}
+
 	if err = containers.Start(conn, container.ID, nil); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return fmt.Errorf("failed to start container: %w", err)
 	}
 
 	var waitOptions containers.WaitOptions
 	waitOptions.Condition = append(waitOptions.Condition, define.ContainerStateRunning)
 	if _, err = containers.Wait(conn, container.ID, &waitOptions); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return fmt.Errorf("failed to wait for container: %w", err)
 	}
+	detachedReady()
 
 	if verbose {
 		var inspectOptions containers.InspectOptions
@@ -93,10 +223,30 @@ func Start(socket string, containerConfig config.ContainerConfig, attach bool, k
 			fmt.Println("Failed to attach to container: ", err)
 		}
 	}
+
+	if cleanup != nil || stop != nil {
+		// Helpers run in this process, so it has to outlive the container
+		if !attach {
+			fmt.Println("Waiting for the container to exit: ", container.ID)
+		}
+		var exitOptions containers.WaitOptions
+		exitOptions.Condition = append(exitOptions.Condition, define.ContainerStateExited, define.ContainerStateStopped)
+		containers.Wait(conn, container.ID, &exitOptions)
+	}
+
+	return nil
+}
+
+func ImageReference(containerConfig config.ContainerConfig) string {
+	// Pin a specific build, defaults to latest
+	if containerConfig.Run.ImageTag != "" {
+		return fmt.Sprintf("%s:%s", containerConfig.ImageName, containerConfig.Run.ImageTag)
+	}
+	return containerConfig.ImageName
 }
 
 func CreateSpec(containerConfig config.ContainerConfig) *specgen.SpecGenerator {
-	spec := specgen.NewSpecGenerator(containerConfig.ImageName, false)
+	spec := specgen.NewSpecGenerator(ImageReference(containerConfig), false)
 	terminal := true
 	stdin := true
 	remove := true
@@ -130,14 +280,35 @@ func CreateSpec(containerConfig config.ContainerConfig) *specgen.SpecGenerator {
 	return spec
 }
 
-func CmdExecuteStart(socket string, verbose bool, keep bool, args []string) {
+func loadConfig(container_name string, tag string) config.ContainerConfig {
+	var containerConfig config.ContainerConfig = config.LoadConfig(container_name)
+	if tag != "" {
+		containerConfig.Run.ImageTag = tag
+	}
+	return containerConfig
+}
+
+func CmdExecuteStart(socket string, verbose bool, keep bool, tag string, args []string) {
 	var container_name string = args[0]
 	var runCmd []string = args[1:]
-	Start(socket, config.LoadConfig(container_name), false, keep, verbose, runCmd)
+	if os.Getenv(detachedEnv) != "" {
+		// The ready pipe of the starting command
+		detachedReadyFile = os.NewFile(3, "ready")
+		os.Unsetenv(detachedEnv)
+	}
+	if err := Start(socket, loadConfig(container_name, tag), false, keep, verbose, runCmd); err != nil {
+		fmt.Println("Failed to start sandbox")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
 }
 
-func CmdExecuteRun(socket string, verbose bool, keep bool, args []string) {
+func CmdExecuteRun(socket string, verbose bool, keep bool, tag string, args []string) {
 	var container_name string = args[0]
 	var runCmd []string = args[1:]
-	Start(socket, config.LoadConfig(container_name), true, keep, verbose, runCmd)
+	if err := Start(socket, loadConfig(container_name, tag), true, keep, verbose, runCmd); err != nil {
+		fmt.Println("Failed to run sandbox")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
 }
@@ -1,11 +1,27 @@
 package run
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 
+	udevtypes "github.com/citilinkru/libudev/types"
 	"github.com/containers/podman/v6/pkg/specgen"
 	"github.com/julioln/sandman/config"
 	"github.com/julioln/sandman/constants"
@@ -110,6 +126,370 @@ func TestCreateSpec(t *testing.T) {
 	}
 }
 
+func TestImageTag(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.ImageName = "image/name"
+	spec := CreateSpec(*testConfig)
+
+	if spec.Image != "image/name" {
+		t.Errorf("image incorrect, expected %s, got %s", "image/name", spec.Image)
+	}
+
+	testConfig.Run.ImageTag = "20240101120000"
+	spec = CreateSpec(*testConfig)
+
+	if spec.Image != "image/name:20240101120000" {
+		t.Errorf("image incorrect, expected %s, got %s", "image/name:20240101120000", spec.Image)
+	}
+	if spec.Hostname != "image_name" {
+		t.Errorf("container hostname incorrect")
+	}
+}
+
+func TestAccessibility(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(fmt.Sprintf("%s/at-spi", dir), 0755)
+	os.WriteFile(fmt.Sprintf("%s/at-spi/bus_0", dir), nil, 0644)
+	t.Setenv("AT_SPI_BUS_ADDRESS", fmt.Sprintf("unix:path=%s/at-spi/bus_0,guid=1234", dir))
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Accessibility = true
+	spec := CreateSpec(*testConfig)
+
+	vars := map[string]string{
+		"AT_SPI_BUS_ADDRESS": fmt.Sprintf("unix:path=%s/at-spi/bus_0,guid=1234", dir),
+	}
+	testMaps(t, vars, spec.Env)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: fmt.Sprintf("%s/at-spi", dir),
+			Source:      fmt.Sprintf("%s/at-spi", dir),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+
+	// Without an address, the bus of the current display is found in the runtime directory
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	os.WriteFile(fmt.Sprintf("%s/at-spi/bus_1", dir), nil, 0644)
+	os.Unsetenv("AT_SPI_BUS_ADDRESS")
+	for display, bus := range map[string]string{":1": "bus_1", ":2.0": "bus_0", "": "bus_0"} {
+		t.Setenv("DISPLAY", display)
+		spec = CreateSpec(*testConfig)
+		if expected := fmt.Sprintf("unix:path=%s/at-spi/%s", dir, bus); spec.Env["AT_SPI_BUS_ADDRESS"] != expected {
+			t.Errorf("display %q, expected the accessibility bus %s, got %s", display, expected, spec.Env["AT_SPI_BUS_ADDRESS"])
+		}
+	}
+	os.Remove(fmt.Sprintf("%s/at-spi/bus_0", dir))
+	os.Remove(fmt.Sprintf("%s/at-spi/bus_1", dir))
+
+	// Missing buses and abstract sockets are skipped
+	for _, address := range []string{"", "unix:path=/nonexistent/at-spi/bus", "unix:abstract=/tmp/dbus-1234"} {
+		if address == "" {
+			os.Unsetenv("AT_SPI_BUS_ADDRESS")
+		} else {
+			t.Setenv("AT_SPI_BUS_ADDRESS", address)
+		}
+		spec = CreateSpec(*testConfig)
+		if _, exists := spec.Env["AT_SPI_BUS_ADDRESS"]; exists {
+			t.Errorf("expected no accessibility bus for address %q", address)
+		}
+		for _, mount := range spec.Mounts {
+			if strings.HasSuffix(mount.Destination, "at-spi") {
+				t.Errorf("unexpected accessibility mount for address %q: %s", address, mount.Destination)
+			}
+		}
+	}
+}
+
+func TestPortals(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	os.MkdirAll(fmt.Sprintf("%s/doc/by-app/name", dir), 0755)
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "name"
+	testConfig.Run.Portals = true
+	spec := CreateSpec(*testConfig)
+
+	// Only the documents granted to the sandbox
+	mountPoints := []specs.Mount{
+		{
+			Destination: fmt.Sprintf("%s/doc", dir),
+			Source:      fmt.Sprintf("%s/doc/by-app/name", dir),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+
+	testConfig.Name = "../name"
+	for _, mount := range CreateSpec(*testConfig).Mounts {
+		if mount.Destination == fmt.Sprintf("%s/doc", dir) {
+			t.Errorf("unexpected documents of app %s: %s", testConfig.Name, mount.Source)
+		}
+	}
+}
+
+// Devices as the udev scanner reads them from sysfs, each below its closest ancestor with a uevent
+func testUdevTree(entries map[string]map[string]string) []*udevtypes.Device {
+	var byPath = map[string]*udevtypes.Device{}
+	var devices []*udevtypes.Device
+	for devpath, env := range entries {
+		dev := &udevtypes.Device{Devpath: "/sys/devices" + devpath, Env: env, Attrs: map[string]string{}}
+		byPath[dev.Devpath] = dev
+		devices = append(devices, dev)
+	}
+	for _, dev := range devices {
+		for dir := filepath.Dir(dev.Devpath); dir != "/sys/devices"; dir = filepath.Dir(dir) {
+			if parent, exists := byPath[dir]; exists {
+				dev.Parent = parent
+				parent.Children = append(parent.Children, dev)
+				break
+			}
+		}
+	}
+	return devices
+}
+
+// Usb webcam, gamepad and keyboard, a bluetooth gamepad, and a video output that isn't a camera
+func testUdevDevices() []*udevtypes.Device {
+	const xhci = "/pci0000:00/0000:00:14.0"
+	return testUdevTree(map[string]map[string]string{
+		xhci:           {"SUBSYSTEM": "pci"},
+		xhci + "/usb1": {"DEVNAME": "bus/usb/001/001", "SUBSYSTEM": "usb", "DEVTYPE": "usb_device"},
+
+		// Webcam, the media controller is next to the video nodes
+		xhci + "/usb1/1-1":                            {"DEVNAME": "bus/usb/001/002", "SUBSYSTEM": "usb", "DEVTYPE": "usb_device"},
+		xhci + "/usb1/1-1/1-1:1.0":                    {"SUBSYSTEM": "usb", "DEVTYPE": "usb_interface"},
+		xhci + "/usb1/1-1/1-1:1.0/video4linux/video0": {"DEVNAME": "video0", "SUBSYSTEM": "video4linux", "ID_V4L_CAPABILITIES": ":capture:"},
+		xhci + "/usb1/1-1/1-1:1.0/video4linux/video1": {"DEVNAME": "video1", "SUBSYSTEM": "video4linux", "ID_V4L_CAPABILITIES": ":"},
+		xhci + "/usb1/1-1/1-1:1.0/media0":             {"DEVNAME": "media0", "SUBSYSTEM": "media"},
+
+		// Gamepad, the input nodes are below inputNN and the hidraw node below the HID device
+		xhci + "/usb1/1-2":                                                  {"DEVNAME": "bus/usb/001/003", "SUBSYSTEM": "usb", "DEVTYPE": "usb_device"},
+		xhci + "/usb1/1-2/1-2:1.0":                                          {"SUBSYSTEM": "usb", "DEVTYPE": "usb_interface"},
+		xhci + "/usb1/1-2/1-2:1.0/0003:054C:0CE6.0002":                      {"SUBSYSTEM": "hid"},
+		xhci + "/usb1/1-2/1-2:1.0/0003:054C:0CE6.0002/input/input12":        {"SUBSYSTEM": "input"},
+		xhci + "/usb1/1-2/1-2:1.0/0003:054C:0CE6.0002/input/input12/event5": {"DEVNAME": "input/event5", "SUBSYSTEM": "input", "ID_INPUT_JOYSTICK": "1"},
+		xhci + "/usb1/1-2/1-2:1.0/0003:054C:0CE6.0002/input/input12/js0":    {"DEVNAME": "input/js0", "SUBSYSTEM": "input", "ID_INPUT_JOYSTICK": "1"},
+		xhci + "/usb1/1-2/1-2:1.0/0003:054C:0CE6.0002/hidraw/hidraw2":       {"DEVNAME": "hidraw2", "SUBSYSTEM": "hidraw"},
+
+		// Keyboard on the same hub, its hidraw node stays out
+		xhci + "/usb1/1-3":                                                 {"DEVNAME": "bus/usb/001/004", "SUBSYSTEM": "usb", "DEVTYPE": "usb_device"},
+		xhci + "/usb1/1-3/1-3:1.0":                                         {"SUBSYSTEM": "usb", "DEVTYPE": "usb_interface"},
+		xhci + "/usb1/1-3/1-3:1.0/0003:046D:C31C.0001":                     {"SUBSYSTEM": "hid"},
+		xhci + "/usb1/1-3/1-3:1.0/0003:046D:C31C.0001/input/input3":        {"SUBSYSTEM": "input"},
+		xhci + "/usb1/1-3/1-3:1.0/0003:046D:C31C.0001/input/input3/event1": {"DEVNAME": "input/event1", "SUBSYSTEM": "input", "ID_INPUT_KEYBOARD": "1"},
+		xhci + "/usb1/1-3/1-3:1.0/0003:046D:C31C.0001/hidraw/hidraw0":      {"DEVNAME": "hidraw0", "SUBSYSTEM": "hidraw"},
+
+		// Bluetooth adapter, paired gamepads are HID devices below it
+		xhci + "/usb1/1-4":                        {"DEVNAME": "bus/usb/001/005", "SUBSYSTEM": "usb", "DEVTYPE": "usb_device"},
+		xhci + "/usb1/1-4/1-4:1.0":                {"SUBSYSTEM": "usb", "DEVTYPE": "usb_interface"},
+		xhci + "/usb1/1-4/1-4:1.0/bluetooth/hci0": {"SUBSYSTEM": "bluetooth"},
+		xhci + "/usb1/1-4/1-4:1.0/bluetooth/hci0/hci0:1/0005:045E:0B13.0003":                       {"SUBSYSTEM": "hid"},
+		xhci + "/usb1/1-4/1-4:1.0/bluetooth/hci0/hci0:1/0005:045E:0B13.0003/input/input20":         {"SUBSYSTEM": "input"},
+		xhci + "/usb1/1-4/1-4:1.0/bluetooth/hci0/hci0:1/0005:045E:0B13.0003/input/input20/event21": {"DEVNAME": "input/event21", "SUBSYSTEM": "input", "ID_INPUT_JOYSTICK": "1"},
+		xhci + "/usb1/1-4/1-4:1.0/bluetooth/hci0/hci0:1/0005:045E:0B13.0003/hidraw/hidraw4":        {"DEVNAME": "hidraw4", "SUBSYSTEM": "hidraw"},
+		xhci + "/usb1/1-4/1-4:1.0/bluetooth/hci0/hci0:2/0005:04E8:7021.0004/hidraw/hidraw5":        {"DEVNAME": "hidraw5", "SUBSYSTEM": "hidraw"},
+
+		// GPU with a video output, not a camera
+		"/pci0000:00/0000:00:02.0":                    {"SUBSYSTEM": "pci"},
+		"/pci0000:00/0000:00:02.0/drm/card0":          {"DEVNAME": "dri/card0", "SUBSYSTEM": "drm"},
+		"/pci0000:00/0000:00:02.0/video4linux/video2": {"DEVNAME": "video2", "SUBSYSTEM": "video4linux", "ID_V4L_CAPABILITIES": ":video_output:"},
+		"/pci0000:00/0000:00:02.0/media1":             {"DEVNAME": "media1", "SUBSYSTEM": "media"},
+	})
+}
+
+func TestCamera(t *testing.T) {
+	paths := CameraPaths(testUdevDevices())
+	expected := []string{"/dev/media0", "/dev/video0"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("camera devices incorrect, expected %#v, got %#v", expected, paths)
+	}
+}
+
+func TestGamepad(t *testing.T) {
+	paths := GamepadPaths(testUdevDevices())
+	expected := []string{"/dev/hidraw2", "/dev/hidraw4", "/dev/input/event21", "/dev/input/event5", "/dev/input/js0"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("gamepad devices incorrect, expected %#v, got %#v", expected, paths)
+	}
+}
+
+func TestClipboard(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "test"
+	testConfig.Run.Clipboard = ClipboardNone
+	spec := CreateSpec(*testConfig)
+	for _, mount := range spec.Mounts {
+		if mount.Destination == "/tmp/.sandman-clipboard" {
+			t.Errorf("unexpected clipboard socket with clipboard %s", ClipboardNone)
+		}
+	}
+
+	testConfig.Run.Clipboard = ClipboardBoth
+	spec = CreateSpec(*testConfig)
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/tmp/.sandman-clipboard",
+			Source:      ClipboardSocketPath(*testConfig),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+
+	testConfig.Run.Clipboard = "invalid"
+	if _, err := NewClipboardPolicy(*testConfig); err == nil {
+		t.Errorf("expected invalid clipboard mode to fail")
+	}
+
+	// Trusted X11 and Wayland clients reach the host clipboard, restricting it would be misleading
+	for _, display := range []func(c *config.ContainerConfig){
+		func(c *config.ContainerConfig) { c.Run.X11, c.Run.X11Trusted = true, true },
+		func(c *config.ContainerConfig) { c.Run.Wayland = true },
+	} {
+		displayConfig := *testConfig
+		display(&displayConfig)
+		for _, mode := range []string{ClipboardNone, ClipboardRead, ClipboardWrite} {
+			displayConfig.Run.Clipboard = mode
+			if _, err := PrepareClipboard(displayConfig, false); err == nil {
+				t.Errorf("expected clipboard %s to abort with %#v", mode, displayConfig.Run)
+			}
+		}
+		displayConfig.Run.Clipboard = ""
+		if _, err := PrepareClipboard(displayConfig, false); err != nil {
+			t.Errorf("expected no clipboard bridge to be accepted, got %s", err)
+		}
+	}
+}
+
+func TestClipboardBridge(t *testing.T) {
+	var hostContent []byte = []byte("host content")
+	host := HostClipboard{
+		Get: func() ([]byte, error) {
+			return hostContent, nil
+		},
+		Set: func(content []byte) error {
+			hostContent = content
+			return nil
+		},
+	}
+
+	request := func(listenPath string, command string, content string) string {
+		conn, err := net.Dial("unix", listenPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "%s\n%s", command, content)
+		conn.(*net.UnixConn).CloseWrite()
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+
+	// Read only
+	readPath := fmt.Sprintf("%s/read", t.TempDir())
+	stop, err := StartClipboardBridge(readPath, "test", ClipboardPolicy{Read: true, MaxSize: 16}, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if reply := request(readPath, "get", ""); reply != "ok\nhost content" {
+		t.Errorf("expected host content, got %q", reply)
+	}
+	if reply := request(readPath, "set", "sandbox"); reply == "ok\n" || string(hostContent) != "host content" {
+		t.Errorf("expected writing to be refused, got %q", reply)
+	}
+
+	// Write only, with a size limit
+	writePath := fmt.Sprintf("%s/write", t.TempDir())
+	stop, err = StartClipboardBridge(writePath, "test", ClipboardPolicy{Write: true, MaxSize: 16}, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if reply := request(writePath, "get", ""); reply == "ok\nhost content" {
+		t.Errorf("expected reading to be refused, got %q", reply)
+	}
+	if reply := request(writePath, "set", "sandbox"); reply != "ok\n" || string(hostContent) != "sandbox" {
+		t.Errorf("expected host clipboard to be written, got %q", reply)
+	}
+	if reply := request(writePath, "set", "more than sixteen bytes"); reply == "ok\n" || string(hostContent) != "sandbox" {
+		t.Errorf("expected content over the limit to be refused, got %q", reply)
+	}
+}
+
+// The CLIPBOARD selection of an X server, hidden from untrusted clients when a trusted one owns it
+type testSelection struct {
+	content []byte
+	trusted bool
+}
+
+func (s *testSelection) clipboards() (HostClipboard, HostClipboard) {
+	host := HostClipboard{
+		Get: func() ([]byte, error) {
+			return s.content, nil
+		},
+		Set: func(content []byte) error {
+			s.content, s.trusted = content, true
+			return nil
+		},
+	}
+	sandbox := HostClipboard{
+		Get: func() ([]byte, error) {
+			if s.trusted {
+				return nil, nil
+			}
+			return s.content, nil
+		},
+		Set: func(content []byte) error {
+			s.content, s.trusted = content, false
+			return nil
+		},
+	}
+	return host, sandbox
+}
+
+func TestClipboardRelay(t *testing.T) {
+	tests := []struct {
+		policy ClipboardPolicy
+		// Seen by the sandbox after a host copy, and by the host after a sandbox copy
+		sandboxSees string
+		hostSees    string
+	}{
+		{ClipboardPolicy{Read: true, Write: true, MaxSize: 16}, "host", "sandbox"},
+		{ClipboardPolicy{Read: true, MaxSize: 16}, "host", "host"},
+		{ClipboardPolicy{Write: true, MaxSize: 16}, "", "sandbox"},
+		{ClipboardPolicy{MaxSize: 16}, "", "host"},
+		{ClipboardPolicy{Read: true, Write: true, MaxSize: 2}, "", "host"},
+	}
+
+	for _, test := range tests {
+		selection := &testSelection{content: []byte("host"), trusted: true}
+		host, sandbox := selection.clipboards()
+		relay := &clipboardRelay{name: "test", policy: test.policy, host: host, sandbox: sandbox}
+
+		relay.sync()
+		if content, _ := sandbox.Get(); string(content) != test.sandboxSees {
+			t.Errorf("policy %#v, expected the sandbox to see %q, got %q", test.policy, test.sandboxSees, content)
+		}
+
+		// Copied by a sandbox client
+		selection.content, selection.trusted = []byte("sandbox"), false
+		relay.sync()
+		if content, _ := host.Get(); string(content) != test.hostSees {
+			t.Errorf("policy %#v, expected the host to see %q, got %q", test.policy, test.hostSees, content)
+		}
+
+		// Host copies after a refused one are relayed again
+		relay.sync()
+		if content, _ := sandbox.Get(); string(content) != test.sandboxSees && test.hostSees == "host" {
+			t.Errorf("policy %#v, expected the sandbox to see %q again, got %q", test.policy, test.sandboxSees, content)
+		}
+	}
+}
+
 func TestDbus(t *testing.T) {
 	testConfig := new(config.ContainerConfig)
 	testConfig.Run.Dbus = true
@@ -130,187 +510,1526 @@ func TestDbus(t *testing.T) {
 	testMountPoints(t, spec, mountPoints)
 }
 
-func TestDevices(t *testing.T) {
+func TestDbusFiltered(t *testing.T) {
 	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Devices = []string{"/dev/test0", "/dev/test1"}
+	testConfig.Name = "name"
+	testConfig.Run.Dbus = true
+	testConfig.Run.DbusSystem = true
+	testConfig.Run.DbusTalk = []string{"org.freedesktop.Notifications"}
+	testConfig.Run.DbusOwn = []string{"org.example.App"}
 	spec := CreateSpec(*testConfig)
 
-	devices := []specs.LinuxDevice{
+	vars := map[string]string{
+		"DBUS_SESSION_BUS_ADDRESS": fmt.Sprintf("unix:path=%s/bus", os.Getenv("XDG_RUNTIME_DIR")),
+		"DBUS_SYSTEM_BUS_ADDRESS":  "unix:path=/run/dbus/system_bus_socket",
+	}
+	testMaps(t, vars, spec.Env)
+
+	mountPoints := []specs.Mount{
 		{
-			Path: "/dev/test0",
+			Destination: fmt.Sprintf("%s/bus", os.Getenv("XDG_RUNTIME_DIR")),
+			Source:      fmt.Sprintf("%s/bus", config.GetSandboxRuntimeDir("name")),
+			Type:        "bind",
 		},
 		{
-			Path: "/dev/test1",
+			Destination: "/run/dbus/system_bus_socket",
+			Source:      fmt.Sprintf("%s/system_bus", config.GetSandboxRuntimeDir("name")),
+			Type:        "bind",
 		},
 	}
-	testDevices(t, spec, devices)
-}
+	testMountPoints(t, spec, mountPoints)
 
-func TestEnv(t *testing.T) {
-	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Env = []string{"PWD", "TEST1=value1"}
-	spec := CreateSpec(*testConfig)
+	args := DbusProxyArgs(*testConfig)
+	expected := []string{
+		dbusSessionBusAddress(),
+		fmt.Sprintf("%s/bus", config.GetSandboxRuntimeDir("name")),
+		"--filter",
+		"--talk=org.freedesktop.Notifications",
+		"--own=org.example.App",
+		dbusSystemBusAddress(),
+		fmt.Sprintf("%s/system_bus", config.GetSandboxRuntimeDir("name")),
+		"--filter",
+		"--talk=org.freedesktop.Notifications",
+		"--own=org.example.App",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("D-Bus proxy arguments incorrect, expected %#v, got %#v", expected, args)
+	}
 
-	vars := map[string]string{
-		"PWD":   os.Getenv("PWD"),
-		"TEST1": "value1",
+	testConfig.Run.DbusSystem = false
+	testConfig.Run.DbusTalk = nil
+	testConfig.Run.DbusOwn = nil
+	if args := DbusProxyArgs(*testConfig); len(args) != 0 {
+		t.Errorf("expected no D-Bus proxy when unfiltered, got %#v", args)
 	}
-	testMaps(t, spec.Env, vars)
 }
 
-func TestFonts(t *testing.T) {
+func TestNotificationsPortals(t *testing.T) {
 	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Fonts = true
+	testConfig.Name = "name"
+	testConfig.Run.Notifications = true
+	testConfig.Run.Portals = true
 	spec := CreateSpec(*testConfig)
 
-	mounts := []specs.Mount{
+	vars := map[string]string{
+		"DBUS_SESSION_BUS_ADDRESS": fmt.Sprintf("unix:path=%s/bus", os.Getenv("XDG_RUNTIME_DIR")),
+		"GTK_USE_PORTAL":           "1",
+	}
+	testMaps(t, vars, spec.Env)
+
+	mountPoints := []specs.Mount{
 		{
-			Destination: "/usr/share/fonts",
-			Source:      "/usr/share/fonts",
+			Destination: fmt.Sprintf("%s/bus", os.Getenv("XDG_RUNTIME_DIR")),
+			Source:      fmt.Sprintf("%s/bus", config.GetSandboxRuntimeDir("name")),
 			Type:        "bind",
-			Options:     []string{"ro"},
 		},
 	}
-	testMountPoints(t, spec, mounts)
+	testMountPoints(t, spec, mountPoints)
+
+	busMounts := 0
+	for _, mount := range spec.Mounts {
+		if mount.Destination == fmt.Sprintf("%s/bus", os.Getenv("XDG_RUNTIME_DIR")) {
+			busMounts++
+		}
+	}
+	if busMounts != 1 {
+		t.Errorf("expected the session bus to be mounted once, got %d", busMounts)
+	}
+
+	args := DbusProxyArgs(*testConfig)
+	expected := []string{
+		dbusSessionBusAddress(),
+		fmt.Sprintf("%s/bus", config.GetSandboxRuntimeDir("name")),
+		"--filter",
+		"--talk=org.freedesktop.Notifications",
+		"--talk=org.freedesktop.portal.*",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("D-Bus proxy arguments incorrect, expected %#v, got %#v", expected, args)
+	}
+
+	// Full access is kept when requested
+	testConfig.Run.Dbus = true
+	if args := DbusProxyArgs(*testConfig); len(args) != 0 {
+		t.Errorf("expected no D-Bus proxy with full access, got %#v", args)
+	}
 }
 
-func TestGpu(t *testing.T) {
+func TestDevices(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Devices = []string{"/dev/null", "/dev/zero"}
+	spec := CreateSpec(*testConfig)
+
 	devices := []specs.LinuxDevice{
 		{
-			Path: "/dev/dri",
+			Path: "/dev/null",
+		},
+		{
+			Path: "/dev/zero",
 		},
 	}
+	testDevices(t, spec, devices)
+}
+
+func TestDevicesResolve(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(fmt.Sprintf("%s/by-id", dir), 0755)
+	for _, name := range []string{"video0", "video1", "event3"} {
+		os.WriteFile(fmt.Sprintf("%s/%s", dir, name), nil, 0644)
+	}
+	os.Symlink("../event3", fmt.Sprintf("%s/by-id/usb-Logitech-event-kbd", dir))
 
 	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Dri = true
+	testConfig.Run.Devices = []string{
+		fmt.Sprintf("%s/video*:r", dir),
+		fmt.Sprintf("%s/by-id/usb-Logitech*:/dev/input/event0:rwm", dir),
+		fmt.Sprintf("%s/missing", dir),
+	}
+	testConfig.Run.DeviceCgroupRules = []string{"c 13:* rwm", "invalid"}
 	spec := CreateSpec(*testConfig)
-	testDevices(t, spec, devices)
 
-	testConfig = new(config.ContainerConfig)
-	testConfig.Run.Gpu = true
-	spec = CreateSpec(*testConfig)
+	devices := []specs.LinuxDevice{
+		{
+			Path: fmt.Sprintf("%s/video0:r", dir),
+		},
+		{
+			Path: fmt.Sprintf("%s/video1:r", dir),
+		},
+		{
+			Path: fmt.Sprintf("%s/event3:/dev/input/event0:rwm", dir),
+		},
+	}
 	testDevices(t, spec, devices)
+	if len(spec.Devices) != len(devices) {
+		t.Errorf("expected %d devices, got %#v", len(devices), spec.Devices)
+	}
+
+	major := int64(13)
+	rules := []specs.LinuxDeviceCgroup{
+		{
+			Allow:  true,
+			Type:   "c",
+			Major:  &major,
+			Access: "rwm",
+		},
+	}
+	if !reflect.DeepEqual(spec.DeviceCgroupRule, rules) {
+		t.Errorf("device cgroup rules incorrect, expected %#v, got %#v", rules, spec.DeviceCgroupRule)
+	}
+
+	// Missing devices only abort when configured to
+	testConfig.Run.DeviceCgroupRules = nil
+	if _, err := PrepareDevices(*testConfig, false); err != nil {
+		t.Errorf("expected missing devices to be skipped, got %s", err)
+	}
+	testConfig.Run.MissingDevices = MissingDevicesError
+	if _, err := PrepareDevices(*testConfig, false); err == nil {
+		t.Errorf("expected missing devices to fail")
+	}
+
+	for _, dev := range []string{"video0", "/dev/video0:x", "/dev/video0:rw:/dev/video1"} {
+		if _, err := ParseDeviceEntry(dev); err == nil {
+			t.Errorf("expected device %s to be invalid", dev)
+		}
+	}
 }
 
-func TestIpc(t *testing.T) {
+func TestEgress(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
 	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Ipc = true
+	testConfig.Name = "name"
+	testConfig.Run.Egress = []string{"*.example.com:443", "10.0.0.0/8"}
 	spec := CreateSpec(*testConfig)
-	nsMode := specgen.NamespaceMode("host")
 
-	if spec.IpcNS.NSMode != nsMode {
-		t.Errorf("Ipc incorrect, expected %s, got %s", nsMode, spec.IpcNS.NSMode)
+	if spec.NetNS.NSMode != specgen.None {
+		t.Errorf("expected only loopback with an egress allowlist, got %#v", spec.NetNS.NSMode)
+	}
+	testMaps(t, map[string]string{"HTTPS_PROXY": "http://127.0.0.1:3128", "NO_PROXY": "localhost,127.0.0.1"}, spec.Env)
+	testMountPoints(t, spec, []specs.Mount{
+		{
+			Source:      egressResolvConfPath(*testConfig),
+			Destination: "/etc/resolv.conf",
+			Type:        "bind",
+			Options:     []string{"ro"},
+		},
+	})
+
+	testConfig.Run.Network = "host"
+	if _, err := PrepareEgress(*testConfig, false); err == nil {
+		t.Errorf("expected Egress with a Network to abort")
+	}
+
+	for entry, invalid := range map[string]bool{"example.com": false, "[fd00::/8]:22": false, "10.1.2.3:5432": false,
+		"example.com:": true, "exa mple.com": true, "example.com:53": true, "*.com:0": true, "[::1": true} {
+		if _, err := ParseEgressRules([]string{entry}); (err != nil) != invalid {
+			t.Errorf("expected %s invalid = %t, got %v", entry, invalid, err)
+		}
+	}
+
+	rules, _ := ParseEgressRules(testConfig.Run.Egress)
+	allowed := map[string]bool{"api.example.com:443": true, "example.com:443": false, "api.example.com:80": false,
+		"evilexample.com:443": false, "10.1.2.3:22": true, "11.1.2.3:22": false}
+	for destination, expected := range allowed {
+		host, port, _ := splitHostPort(destination, 0)
+		if newEgressProxy(rules, false).allowed("test", host, port) != expected {
+			t.Errorf("expected %s allowed = %t", destination, expected)
+		}
+	}
+	if ports := egressPorts(rules); !reflect.DeepEqual(ports, []uint16{443}) {
+		t.Errorf("expected transparent ports [443], got %v", ports)
+	}
+}
+
+func egressDnsQuery(name string) []byte {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	return append(query, 0, 0, dnsTypeA, 0, dnsClassIN)
+}
+
+func TestEgressDns(t *testing.T) {
+	rules, _ := ParseEgressRules([]string{"*.example.com:443", "10.0.0.0/8"})
+	proxy := newEgressProxy(rules, false)
+
+	response, ok := proxy.dnsAnswer(egressDnsQuery("api.example.com"))
+	if !ok || response[3]&0x0f != 0 || binary.BigEndian.Uint16(response[6:]) != 1 {
+		t.Fatalf("expected an answer for an allowed name, got %v", response)
+	}
+	if !net.IP(response[len(response)-4:]).Equal(net.ParseIP(egressListenIP)) || response[0] != 0x12 || response[1] != 0x34 {
+		t.Errorf("expected the loopback address for the query, got %v", response)
+	}
+
+	response, ok = proxy.dnsAnswer(egressDnsQuery("example.org"))
+	if !ok || response[3]&0x0f != dnsRcodeNX || binary.BigEndian.Uint16(response[6:]) != 0 {
+		t.Errorf("expected NXDOMAIN for a denied name, got %v", response)
+	}
+
+	if _, ok := proxy.dnsAnswer([]byte{1, 2, 3}); ok {
+		t.Errorf("expected truncated queries to be dropped")
+	}
+}
+
+// Forwards every dial of the proxy to the stub upstream
+func egressTestProxy(t *testing.T, entries []string, upstream string) (*egressProxy, chan string) {
+	rules, err := ParseEgressRules(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed := make(chan string, 4)
+	proxy := newEgressProxy(rules, false)
+	proxy.dial = func(network string, address string) (net.Conn, error) {
+		dialed <- address
+		return net.Dial(network, upstream)
+	}
+	return proxy, dialed
+}
+
+func egressTestListener(t *testing.T, handle func(net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveListener(listener, handle)
+	return listener.Addr().String()
+}
+
+func TestEgressProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	proxy, dialed := egressTestProxy(t, []string{"*.example.com", "10.0.0.0/8:8080"}, upstream.Listener.Addr().String())
+	proxyAddress := egressTestListener(t, proxy.serveProxyClient)
+	proxyURL, _ := url.Parse("http://" + proxyAddress)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	response, err := client.Get("http://api.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "upstream" || <-dialed != "api.example.com:80" {
+		t.Errorf("expected the allowed request to reach the upstream, got %s", body)
+	}
+
+	response, err = client.Get("http://example.org/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected denied request to be forbidden, got %d", response.StatusCode)
+	}
+
+	// CONNECT tunnels
+	for target, status := range map[string]string{"10.1.2.3:8080": "200", "10.1.2.3:22": "403"} {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if !strings.Contains(line, " "+status+" ") {
+			t.Errorf("expected CONNECT %s to return %s, got %s", target, status, line)
+		}
+		conn.Close()
+	}
+	if address := <-dialed; address != "10.1.2.3:8080" {
+		t.Errorf("expected the tunnel to dial 10.1.2.3:8080, got %s", address)
+	}
+}
+
+func TestEgressDestination(t *testing.T) {
+	rules, err := ParseEgressRules([]string{"example.com", "10.0.0.0/8:8080", "127.0.0.1:631"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newEgressProxy(rules, false)
+
+	// Hostname rules don't reach local or private addresses, only IP and CIDR rules do
+	for address, allowed := range map[string]bool{
+		"93.184.216.34:443":     true,
+		"[2606:2800::1]:443":    true,
+		"10.1.2.3:8080":         true,
+		"127.0.0.1:631":         true,
+		"10.1.2.3:443":          false,
+		"127.0.0.1:80":          false,
+		"[::1]:443":             false,
+		"[::ffff:127.0.0.1]:80": false,
+		"0.0.0.0:80":            false,
+		"169.254.169.254:80":    false,
+		"[fe80::1]:443":         false,
+		"192.168.1.1:443":       false,
+		"[fd00::1]:443":         false,
+		"100.64.0.1:443":        false,
+	} {
+		if err := proxy.checkDestination("tcp", address, nil); (err == nil) != allowed {
+			t.Errorf("expected %s allowed: %t, got %v", address, allowed, err)
+		}
+	}
+}
+
+func TestEgressTransparent(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	proxy, dialed := egressTestProxy(t, []string{"*.example.com:443"}, upstream.Listener.Addr().String())
+	address := egressTestListener(t, func(client net.Conn) {
+		proxy.serveTransparentClient(client, 443)
+	})
+
+	// Names resolve to the listener, routed by SNI
+	transport := upstream.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return net.Dial(network, address)
+	}
+	client := &http.Client{Transport: transport}
+
+	response, err := client.Get("https://api.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "upstream" || <-dialed != "api.example.com:443" {
+		t.Errorf("expected the allowed name to reach the upstream, got %s", body)
+	}
+
+	if _, err := client.Get("https://example.org/"); err == nil {
+		t.Errorf("expected a denied name to be refused")
+	}
+	select {
+	case address := <-dialed:
+		t.Errorf("expected nothing dialed for a denied name, got %s", address)
+	default:
+	}
+}
+
+func TestEnv(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Env = []string{"PWD", "TEST1=value1"}
+	spec := CreateSpec(*testConfig)
+
+	vars := map[string]string{
+		"PWD":   os.Getenv("PWD"),
+		"TEST1": "value1",
+	}
+	testMaps(t, spec.Env, vars)
+}
+
+func TestFonts(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Fonts = true
+	spec := CreateSpec(*testConfig)
+
+	mounts := []specs.Mount{
+		{
+			Destination: "/usr/share/fonts",
+			Source:      "/usr/share/fonts",
+			Type:        "bind",
+			Options:     []string{"ro"},
+		},
+	}
+	testMountPoints(t, spec, mounts)
+}
+
+func TestGpgAgent(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.GpgAgent = true
+	spec := CreateSpec(*testConfig)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/home/user/.gnupg/S.gpg-agent",
+			Source:      gpgAgentExtraSocket(),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+	testMaps(t, map[string]string{"GNUPGHOME": "/home/user/.gnupg"}, spec.Env)
+
+	// Not in the host runtime dir, gpg in the container doesn't look there
+	for _, mount := range spec.Mounts {
+		if strings.HasPrefix(mount.Destination, os.Getenv("XDG_RUNTIME_DIR")+"/gnupg") {
+			t.Errorf("unexpected agent socket in the host runtime dir: %s", mount.Destination)
+		}
+	}
+}
+
+func TestGpu(t *testing.T) {
+	devices := []specs.LinuxDevice{
+		{
+			Path: "/dev/dri",
+		},
+	}
+
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Dri = true
+	spec := CreateSpec(*testConfig)
+	testDevices(t, spec, devices)
+
+	testConfig = new(config.ContainerConfig)
+	testConfig.Run.Gpu = GpuFull
+	spec = CreateSpec(*testConfig)
+	testDevices(t, spec, devices)
+
+	testConfig.Run.Gpu = "invalid"
+	if _, err := PrepareGpu(*testConfig, false); err == nil {
+		t.Errorf("expected invalid GPU mode to fail")
+	}
+}
+
+func TestGpuPci(t *testing.T) {
+	sysfs := t.TempDir()
+	for _, node := range []string{"card1", "renderD129"} {
+		os.MkdirAll(fmt.Sprintf("%s/0000:01:00.0/drm/%s", sysfs, node), 0755)
+	}
+
+	nodes, err := PciDriNodes(sysfs, "0000:01:00.0", false)
+	if err != nil || !reflect.DeepEqual(nodes, []string{"/dev/dri/card1", "/dev/dri/renderD129"}) {
+		t.Errorf("GPU nodes incorrect, got %#v (%v)", nodes, err)
+	}
+
+	nodes, err = PciDriNodes(sysfs, "0000:01:00.0", true)
+	if err != nil || !reflect.DeepEqual(nodes, []string{"/dev/dri/renderD129"}) {
+		t.Errorf("GPU render nodes incorrect, got %#v (%v)", nodes, err)
+	}
+
+	if _, err := PciDriNodes(sysfs, "0000:02:00.0", false); err == nil {
+		t.Errorf("expected missing GPU to fail")
+	}
+}
+
+func TestCdiDevice(t *testing.T) {
+	etc := t.TempDir()
+	run := t.TempDir()
+
+	os.WriteFile(fmt.Sprintf("%s/nvidia.yaml", etc), []byte(`cdiVersion: 0.5.0
+kind: nvidia.com/gpu
+devices:
+  - name: "0"
+    containerEdits:
+      deviceNodes:
+        - path: /dev/nvidia0
+  - name: all
+    containerEdits:
+      deviceNodes:
+        - path: /dev/nvidia0
+        - path: /dev/nvidia1
+containerEdits:
+  deviceNodes:
+    - path: /dev/nvidiactl
+`), 0644)
+	os.WriteFile(fmt.Sprintf("%s/vendor.json", run), []byte(`{"cdiVersion": "0.5.0", "kind": "vendor.com/device", "devices": [{"name": "dev0", "containerEdits": {"deviceNodes": [{"path": "/dev/vendor0"}]}}]}`), 0644)
+
+	dirs := []string{run, etc}
+	resolved := map[string][]string{
+		"nvidia.com/gpu=all":     {"/dev/nvidiactl", "/dev/nvidia0", "/dev/nvidia1"},
+		"nvidia.com/gpu=0":       {"/dev/nvidiactl", "/dev/nvidia0"},
+		"vendor.com/device=dev0": {"/dev/vendor0"},
+	}
+	for name, expected := range resolved {
+		nodes, err := ResolveCdiDevice(name, dirs)
+		if err != nil || !reflect.DeepEqual(nodes, expected) {
+			t.Errorf("CDI device %s incorrect, expected %#v, got %#v (%v)", name, expected, nodes, err)
+		}
+	}
+
+	for _, name := range []string{"nvidia.com/gpu=1", "amd.com/gpu=all"} {
+		if _, err := ResolveCdiDevice(name, dirs); err == nil {
+			t.Errorf("expected CDI device %s not to be found", name)
+		}
+	}
+
+	if !IsCdiDevice("nvidia.com/gpu=all") || IsCdiDevice(GpuRenderOnly) || IsCdiDevice("gpu=all") {
+		t.Errorf("CDI device names incorrectly detected")
+	}
+
+	cdiSpecDirs = dirs
+	defer func() { cdiSpecDirs = []string{"/var/run/cdi", "/etc/cdi"} }()
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Gpu = "nvidia.com/gpu=all"
+	if devices, err := GpuDevices(*testConfig); err != nil || !reflect.DeepEqual(devices, []string{"nvidia.com/gpu=all"}) {
+		t.Errorf("CDI GPU devices incorrect, got %#v (%v)", devices, err)
+	}
+
+	// Selected by the CDI name only
+	testConfig.Run.GpuPci = "0000:01:00.0"
+	if _, err := PrepareGpu(*testConfig, false); err == nil {
+		t.Errorf("expected a CDI device with GpuPci to fail")
+	}
+}
+
+// Echoes a line back, as a host service
+func hostServiceTestEcho(t *testing.T, listener net.Listener) {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprint(conn, line)
+			conn.Close()
+		}
+	}()
+}
+
+func hostServiceTestRequest(t *testing.T, network string, address string) string {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "ping\n")
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	return line
+}
+
+func TestHostServices(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	servicePath := fmt.Sprintf("%s/app.sock", t.TempDir())
+	serviceListener, err := net.Listen("unix", servicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostServiceTestEcho(t, serviceListener)
+
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "name"
+	testConfig.Run.HostServices = []string{"tcp:127.0.0.1:11434", "unix:" + servicePath, "invalid"}
+	spec := CreateSpec(*testConfig)
+	testMountPoints(t, spec, []specs.Mount{
+		{
+			Source:      hostServiceSocketPath(*testConfig, 1),
+			Destination: servicePath,
+			Type:        "bind",
+		},
+	})
+	if spec.NetNS.NSMode != specgen.None {
+		t.Errorf("expected no network with host services, got %#v", spec.NetNS.NSMode)
+	}
+
+	if _, err := PrepareHostServices(*testConfig, false); err == nil {
+		t.Errorf("expected an invalid host service to abort")
+	}
+	for _, services := range [][]string{{"tcp:localhost"}, {"tcp:127.0.0.1:0"}, {"unix:app.sock"}, {"tcp:127.0.0.1:80", "tcp:[::1]:80"}} {
+		testConfig.Run.HostServices = services
+		if _, err := PrepareHostServices(*testConfig, false); err == nil {
+			t.Errorf("expected invalid host services %v to abort", services)
+		}
+	}
+
+	testConfig.Run.HostServices = []string{"tcp:127.0.0.1:53"}
+	testConfig.Run.Egress = []string{"example.com"}
+	if _, err := PrepareHostServices(*testConfig, false); err == nil {
+		t.Errorf("expected a host service on an egress port to abort")
+	}
+	testConfig.Run.Egress = nil
+	testConfig.Run.Network = "host"
+	if _, err := PrepareHostServices(*testConfig, false); err == nil {
+		t.Errorf("expected host services with the host network to abort")
+	}
+	testConfig.Run.Network = ""
+
+	// Unix sockets are relayed from the runtime directory
+	testConfig.Run.HostServices = []string{"tcp:127.0.0.1:11434", "unix:" + servicePath}
+	stop, err := PrepareHostServices(*testConfig, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if line := hostServiceTestRequest(t, "unix", hostServiceSocketPath(*testConfig, 1)); line != "ping\n" {
+		t.Errorf("expected the unix service to answer, got %q", line)
+	}
+
+	// TCP relays, listening in the container network namespace when running
+	tcpService, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostServiceTestEcho(t, tcpService)
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go serveHostService(relay, HostService{Network: "tcp", Address: tcpService.Addr().String()})
+	if line := hostServiceTestRequest(t, "tcp", relay.Addr().String()); line != "ping\n" {
+		t.Errorf("expected the tcp service to answer, got %q", line)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "test"
+	testConfig.ImageName = "image/name"
+	testConfig.Run.IdentityUser = true
+
+	// Opt-in
+	if _, err := PrepareIdentity(*testConfig, false); err != nil {
+		t.Fatal(err)
+	}
+	if spec := CreateSpec(*testConfig); len(spec.Mounts) != 0 || spec.Env["USER"] != "" {
+		t.Errorf("unexpected identity without GenerateIdentity: %#v", spec.Mounts)
+	}
+	if _, err := os.Stat(config.GetIdentityDir("test")); err == nil {
+		t.Errorf("unexpected identity generated without GenerateIdentity")
+	}
+
+	testConfig.Run.GenerateIdentity = true
+	if _, err := PrepareIdentity(*testConfig, false); err != nil {
+		t.Fatal(err)
+	}
+	spec := CreateSpec(*testConfig)
+
+	hostname := readIdentity(*testConfig, identityHostname)
+	if hostname == "" || spec.Hostname != hostname {
+		t.Errorf("Hostname incorrect, expected %s, got %s", hostname, spec.Hostname)
+	}
+	if machineId := readIdentity(*testConfig, identityMachineId); len(machineId) != 32 {
+		t.Errorf("Invalid machine-id: %s", machineId)
+	}
+
+	username := readIdentity(*testConfig, identityUsername)
+	vars := map[string]string{
+		"USER":    username,
+		"LOGNAME": username,
+	}
+	testMaps(t, vars, spec.Env)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/etc/machine-id",
+			Source:      fmt.Sprintf("%s/machine-id", config.GetIdentityDir("test")),
+			Type:        "bind",
+			Options:     []string{"ro"},
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+
+	// Kept across runs
+	if _, err := PrepareIdentity(*testConfig, false); err != nil {
+		t.Fatal(err)
+	}
+	if CreateSpec(*testConfig).Hostname != hostname {
+		t.Errorf("Hostname changed between runs")
+	}
+
+	// Shared by sandboxes with the same profile
+	otherConfig := *testConfig
+	otherConfig.Name = "other"
+	otherConfig.Run.Identity = "test"
+	if CreateSpec(otherConfig).Hostname != hostname {
+		t.Errorf("Hostname not shared by the identity profile")
+	}
+
+	// Rotated on reset
+	if err := ResetIdentity(*testConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrepareIdentity(*testConfig, false); err != nil {
+		t.Fatal(err)
+	}
+	if readIdentity(*testConfig, identityHostname) == hostname {
+		t.Errorf("Hostname not rotated after reset")
+	}
+
+	// The name wins over the generated hostname, an explicit one over both
+	testConfig.Run.Name = "named"
+	if spec := CreateSpec(*testConfig); spec.Name != "named" || spec.Hostname != "named" {
+		t.Errorf("Hostname incorrect, expected named, got %s", spec.Hostname)
+	}
+	testConfig.Run.Hostname = "explicit"
+	if spec := CreateSpec(*testConfig); spec.Hostname != "explicit" {
+		t.Errorf("Hostname incorrect, expected explicit, got %s", spec.Hostname)
+	}
+
+	// Profiles are names in the identity store, never paths
+	for _, profile := range []string{"../../..", "a/b", "/tmp", ".."} {
+		invalidConfig := *testConfig
+		invalidConfig.Run.Identity = profile
+		if err := ResetIdentity(invalidConfig); err == nil {
+			t.Errorf("expected the reset of profile %s to fail", profile)
+		}
+		if _, err := PrepareIdentity(invalidConfig, false); err == nil {
+			t.Errorf("expected the profile %s to abort", profile)
+		}
+	}
+	if _, err := os.Stat(config.GetIdentityDir("test")); err != nil {
+		t.Errorf("Identity removed by an invalid profile: %s", err)
+	}
+
+	// Slashes of the sandbox name are replaced
+	nestedConfig := *testConfig
+	nestedConfig.Name = "apps/browser"
+	if profile, err := IdentityProfile(nestedConfig); err != nil || profile != "apps_browser" {
+		t.Errorf("Profile incorrect, expected apps_browser, got %s (%v)", profile, err)
+	}
+
+	// Audio sandboxes only get a machine-id
+	audioConfig := new(config.ContainerConfig)
+	audioConfig.Name = "audio"
+	audioConfig.Run.Audio = AudioPulse
+	if _, err := PrepareIdentity(*audioConfig, false); err != nil {
+		t.Fatal(err)
+	}
+	if readIdentity(*audioConfig, identityMachineId) == "" {
+		t.Errorf("Missing machine-id of an audio sandbox")
+	}
+	if _, err := os.Stat(identityPath("audio", identityHostname)); err == nil {
+		t.Errorf("unexpected hostname generated for an audio sandbox")
+	}
+}
+
+func TestIpc(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Ipc = true
+	spec := CreateSpec(*testConfig)
+	nsMode := specgen.NamespaceMode("host")
+
+	if spec.IpcNS.NSMode != nsMode {
+		t.Errorf("Ipc incorrect, expected %s, got %s", nsMode, spec.IpcNS.NSMode)
+	}
+}
+
+func TestName(t *testing.T) {
+	name := "testing_name_override"
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "original_name"
+	testConfig.Run.Name = name
+	spec := CreateSpec(*testConfig)
+
+	if spec.Name != name {
+		t.Errorf("Name incorrect, expected %s, got %s", spec.Name, name)
+	}
+	if spec.Hostname != name {
+		t.Errorf("Hostname incorrect, expected %s, got %s", spec.Hostname, name)
+	}
+
+	testConfig.Run.Hostname = "hostname"
+	spec = CreateSpec(*testConfig)
+	if spec.Name != name || spec.Hostname != "hostname" {
+		t.Errorf("Hostname incorrect, expected hostname, got %s", spec.Hostname)
+	}
+}
+
+func TestOpenOnHost(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "test"
+	testConfig.Run.OpenOnHost = true
+	spec := CreateSpec(*testConfig)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/tmp/.sandman-open",
+			Source:      OpenOnHostSocketPath(*testConfig),
+			Type:        "bind",
+		},
+		{
+			Destination: "/usr/local/bin/xdg-open",
+			Source:      OpenOnHostShimPath(*testConfig),
+			Type:        "bind",
+			Options:     []string{"ro"},
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+}
+
+func TestOpenOnHostAllowed(t *testing.T) {
+	schemes := []string{"http", "https", "mailto"}
+	allowed := []string{"https://example.com/a?b=c", "HTTP://example.com", "mailto:me@example.com"}
+	refused := []string{"file:///etc/passwd", "/home/user/file.pdf", "-version", "javascript:alert(1)", "https://example.com/\nfile:///etc"}
+
+	for _, u := range allowed {
+		if err := OpenOnHostAllowed(u, schemes); err != nil {
+			t.Errorf("expected %q to be allowed, got %s", u, err)
+		}
+	}
+	for _, u := range refused {
+		if err := OpenOnHostAllowed(u, schemes); err == nil {
+			t.Errorf("expected %q to be refused", u)
+		}
+	}
+}
+
+func TestStartOpenOnHost(t *testing.T) {
+	listenPath := fmt.Sprintf("%s/open", t.TempDir())
+	opened := make(chan string, 1)
+
+	allowed := func(rawURL string) error {
+		return OpenOnHostAllowed(rawURL, []string{"https"})
+	}
+	open := func(rawURL string) error {
+		opened <- rawURL
+		return nil
+	}
+	stop, err := StartOpenOnHost(listenPath, allowed, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	send := func(rawURL string) string {
+		conn, err := net.Dial("unix", listenPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, rawURL)
+		reply := make([]byte, 256)
+		n, _ := conn.Read(reply)
+		return string(reply[:n])
+	}
+
+	if reply := send("https://example.com"); reply != "ok\n" {
+		t.Errorf("expected ok, got %q", reply)
+	}
+	if u := <-opened; u != "https://example.com" {
+		t.Errorf("expected https://example.com to be opened, got %s", u)
+	}
+
+	if reply := send("file:///etc/passwd"); reply == "ok\n" {
+		t.Errorf("expected file:///etc/passwd to be refused")
+	}
+	select {
+	case u := <-opened:
+		t.Errorf("unexpected open: %s", u)
+	default:
+	}
+}
+
+func TestPipewire(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Pipewire = true
+	spec := CreateSpec(*testConfig)
+
+	vars := map[string]string{
+		"XDG_RUNTIME_DIR": os.Getenv("XDG_RUNTIME_DIR"),
+		"PIPEWIRE_REMOTE": fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR")),
+	}
+	testMaps(t, spec.Env, vars)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR")),
+			Source:      fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR")),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+}
+
+func TestPorts(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Ports = []string{"3000:4000", "invalid", "0.0.0.0:8000-8002:9000-9002/udp", "[::1]:53:53/sctp", "1:2:3", "80-81:80"}
+	spec := CreateSpec(*testConfig)
+	ports := []types.PortMapping{
+		{
+			HostIP:        "127.0.0.1",
+			ContainerPort: 4000,
+			HostPort:      3000,
+			Protocol:      "tcp",
+		},
+		{
+			HostIP:        "0.0.0.0",
+			ContainerPort: 9000,
+			HostPort:      8000,
+			Range:         3,
+			Protocol:      "udp",
+		},
+		{
+			HostIP:        "::1",
+			ContainerPort: 53,
+			HostPort:      53,
+			Protocol:      "sctp",
+		},
+	}
+	testPorts(t, spec, ports)
+	if len(spec.PortMappings) != len(ports) {
+		t.Errorf("expected %d ports, got %#v", len(ports), spec.PortMappings)
+	}
+
+	for entry, ambiguous := range map[string]bool{"3000:4000": true, "8080:8080": false, "3000:4000/tcp": false, "127.0.0.1:3000:4000": false} {
+		if _, a, err := ParsePortMapping(entry); err != nil || a != ambiguous {
+			t.Errorf("expected %s ambiguous = %t, got %t (%v)", entry, ambiguous, a, err)
+		}
+	}
+	for _, entry := range []string{"8080", "8080:80/icmp", "0:80", "70000:80", "81-80:80-81", "host:80:80"} {
+		testConfig.Run.Ports = []string{entry}
+		if _, err := PreparePorts(*testConfig, false); err == nil {
+			t.Errorf("expected invalid port %s to abort", entry)
+		}
+	}
+}
+
+func TestPrinting(t *testing.T) {
+	cupsHostSocket = fmt.Sprintf("%s/cups.sock", t.TempDir())
+	t.Cleanup(func() { cupsHostSocket = cupsSocket })
+
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Printing = true
+
+	// Nothing to share without a local scheduler
+	spec := CreateSpec(*testConfig)
+	if _, exists := spec.Env["CUPS_SERVER"]; exists {
+		t.Errorf("unexpected CUPS_SERVER without a CUPS socket")
+	}
+	for _, mount := range spec.Mounts {
+		if mount.Destination == "/run/cups/cups.sock" {
+			t.Errorf("unexpected CUPS socket mount from %s", mount.Source)
+		}
+	}
+	var prepareErr error
+	output := captureOutput(func() { _, prepareErr = PreparePrinting(*testConfig, false) })
+	if prepareErr != nil {
+		t.Errorf("unexpected error without a CUPS socket: %v", prepareErr)
+	}
+	if !strings.HasPrefix(string(output), "Warning: printing unavailable") {
+		t.Errorf("expected a warning without a CUPS socket, got %q", output)
+	}
+
+	listener, err := net.Listen("unix", cupsHostSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	spec = CreateSpec(*testConfig)
+
+	vars := map[string]string{
+		"CUPS_SERVER": "/run/cups/cups.sock",
+	}
+	testMaps(t, vars, spec.Env)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/run/cups/cups.sock",
+			Source:      cupsHostSocket,
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+}
+
+// A usb scanner and keyboard, with the interface classes the selectors read from sysfs
+func testScannerDevices(t *testing.T) []*udevtypes.Device {
+	var devices []*udevtypes.Device
+	for i, class := range []string{"06", "03"} {
+		devpath := fmt.Sprintf("%s/1-%d", t.TempDir(), i+1)
+		os.MkdirAll(fmt.Sprintf("%s/1-%d:1.0", devpath, i+1), 0755)
+		os.WriteFile(fmt.Sprintf("%s/1-%d:1.0/bInterfaceClass", devpath, i+1), []byte(class+"\n"), 0644)
+		devices = append(devices, &udevtypes.Device{
+			Devpath: devpath,
+			Env:     map[string]string{"DEVNAME": fmt.Sprintf("bus/usb/001/%03d", i+2)},
+			Attrs:   map[string]string{"bDeviceClass": "00"},
+		})
+	}
+	return devices
+}
+
+func TestScanning(t *testing.T) {
+	devices := testScannerDevices(t)
+	defaultScanDevices := scanDevices
+	scanDevices = func() ([]*udevtypes.Device, error) { return devices, nil }
+	saneHostConfigDir = t.TempDir()
+	t.Cleanup(func() {
+		scanDevices = defaultScanDevices
+		saneHostConfigDir = saneConfigDir
+	})
+
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.Scanning = true
+	spec := CreateSpec(*testConfig)
+
+	// Still image class by default
+	expected := []specs.LinuxDevice{{Path: "/dev/bus/usb/001/002"}}
+	if !reflect.DeepEqual(spec.Devices, expected) {
+		t.Errorf("scanner devices incorrect, expected %#v, got %#v", expected, spec.Devices)
+	}
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/etc/sane.d",
+			Source:      saneHostConfigDir,
+			Type:        "bind",
+			Options:     []string{"ro"},
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+
+	testConfig.Run.ScannerDevices = []string{"class=hid"}
+	spec = CreateSpec(*testConfig)
+	expected = []specs.LinuxDevice{{Path: "/dev/bus/usb/001/003"}}
+	if !reflect.DeepEqual(spec.Devices, expected) {
+		t.Errorf("scanner devices incorrect, expected %#v, got %#v", expected, spec.Devices)
+	}
+
+	// No SANE configuration on the host
+	saneHostConfigDir = fmt.Sprintf("%s/missing", t.TempDir())
+	for _, mount := range CreateSpec(*testConfig).Mounts {
+		if mount.Destination == "/etc/sane.d" {
+			t.Errorf("unexpected SANE configuration mount from %s", mount.Source)
+		}
+	}
+}
+
+func TestPulseaudio(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "test"
+	testConfig.Run.Pulseaudio = true
+	spec := CreateSpec(*testConfig)
+
+	vars := map[string]string{
+		"XDG_RUNTIME_DIR": os.Getenv("XDG_RUNTIME_DIR"),
+		"PULSE_SERVER":    fmt.Sprintf("unix:%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
+	}
+	testMaps(t, spec.Env, vars)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/etc/machine-id",
+			Source:      MachineIdPath(*testConfig),
+			Type:        "bind",
+			Options:     []string{"ro"},
+		},
+		{
+			Destination: fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
+			Source:      fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+}
+
+func TestAudioMode(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	if mode := AudioMode(*testConfig); mode != AudioNone {
+		t.Errorf("expected audio mode %s, got %s", AudioNone, mode)
+	}
+
+	testConfig.Run.Pulseaudio = true
+	testConfig.Run.Pipewire = true
+	if mode := AudioMode(*testConfig); mode != AudioPipewirePulse {
+		t.Errorf("expected audio mode %s, got %s", AudioPipewirePulse, mode)
+	}
+
+	// The explicit mode wins over the legacy toggles
+	testConfig.Run.Audio = AudioNone
+	spec := CreateSpec(*testConfig)
+	if _, exists := spec.Env["PULSE_SERVER"]; exists {
+		t.Errorf("expected no audio with mode %s", AudioNone)
+	}
+	if _, exists := spec.Env["PIPEWIRE_REMOTE"]; exists {
+		t.Errorf("expected no audio with mode %s", AudioNone)
+	}
+}
+
+func TestAudioPlaybackOnly(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "test"
+	testConfig.Run.Audio = AudioPipewire
+	testConfig.Run.AudioPlaybackOnly = true
+	spec := CreateSpec(*testConfig)
+
+	// Only the filtered PulseAudio socket is shared
+	if _, exists := spec.Env["PIPEWIRE_REMOTE"]; exists {
+		t.Errorf("expected no pipewire socket in playback only mode")
+	}
+
+	vars := map[string]string{
+		"PULSE_SERVER":       fmt.Sprintf("unix:%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
+		"PULSE_CLIENTCONFIG": pulseClientConfigDestination,
+	}
+	testMaps(t, vars, spec.Env)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
+			Source:      PulseProxyPath(*testConfig),
+			Type:        "bind",
+		},
+		{
+			Destination: pulseClientConfigDestination,
+			Source:      PulseClientConfigPath(*testConfig),
+			Type:        "bind",
+			Options:     []string{"ro"},
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+}
+
+func pulseTestPacket(command uint32, tag uint32) []byte {
+	var payload []byte
+	for _, v := range []uint32{command, tag} {
+		payload = append(payload, pulseTagU32)
+		payload = binary.BigEndian.AppendUint32(payload, v)
+	}
+	descriptor := make([]byte, pulseDescriptorSize)
+	binary.BigEndian.PutUint32(descriptor, uint32(len(payload)))
+	binary.BigEndian.PutUint32(descriptor[4:], pulseControlChannel)
+	return append(descriptor, payload...)
+}
+
+// Commands missing from the playback allowlist
+const (
+	pulseCommandCreateRecordStream = 5
+	pulseCommandLoadModule         = 51
+)
+
+func TestPulseProxy(t *testing.T) {
+	serverPath := fmt.Sprintf("%s/native", t.TempDir())
+	proxyPath := fmt.Sprintf("%s/pulse", t.TempDir())
+
+	server, err := net.Listen("unix", serverPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	received := make(chan uint32, 2)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			packet, err := readPulsePacket(conn)
+			if err != nil {
+				return
+			}
+			command, _, _ := packet.command()
+			received <- command
+		}
+	}()
+
+	stop, err := StartPulseProxy(serverPath, proxyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	client, err := net.Dial("unix", proxyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Record streams, modules, moving streams and ports are refused by the proxy
+	for i, command := range []uint32{pulseCommandCreateRecordStream, pulseCommandLoadModule, 52, 67, 90, 96} {
+		tag := uint32(42 + i)
+		client.Write(pulseTestPacket(command, tag))
+		reply, err := readPulsePacket(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replyCommand, replyTag, _ := reply.command(); replyCommand != pulseCommandError || replyTag != tag {
+			t.Errorf("expected error reply to command %d, got command %d for tag %d", command, replyCommand, replyTag)
+		}
+	}
+
+	// Playback commands reach the server
+	client.Write(pulseTestPacket(3, 43))
+	if command := <-received; command != 3 {
+		t.Errorf("expected playback stream command to be forwarded, got %d", command)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	var ns specgen.Namespace
+
+	testConfig.Run.Net = true
+	testConfig.Run.Network = ""
+	spec := CreateSpec(*testConfig)
+	ns.NSMode = specgen.Slirp
+	if spec.NetNS.NSMode != ns.NSMode {
+		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
+	}
+
+	testConfig.Run.Net = false
+	testConfig.Run.Network = ""
+	spec = CreateSpec(*testConfig)
+	ns.NSMode = specgen.None
+	if spec.NetNS.NSMode != ns.NSMode {
+		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
+	}
+
+	testConfig.Run.Net = false
+	testConfig.Run.Network = "host"
+	spec = CreateSpec(*testConfig)
+	ns, _, _, _ = specgen.ParseNetworkFlag([]string{"host"})
+	if spec.NetNS.NSMode != ns.NSMode {
+		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
+	}
+
+	testConfig.Run.Net = false
+	testConfig.Run.Network = "other"
+	testConfig.Run.StaticIP = "10.89.0.10"
+	testConfig.Run.Dns = []string{"10.89.0.1", "invalid"}
+	testConfig.Run.DnsSearch = []string{"sandbox.internal"}
+	testConfig.Run.ExtraHosts = []string{"db.internal:10.89.0.2", "invalid"}
+	spec = CreateSpec(*testConfig)
+	ns.NSMode = specgen.Bridge
+	if spec.NetNS.NSMode != ns.NSMode {
+		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
+	}
+	if options, exists := spec.Networks["other"]; !exists || len(options.StaticIPs) != 1 || !options.StaticIPs[0].Equal(net.ParseIP("10.89.0.10")) {
+		t.Errorf("expected network other with the static IP, got %#v", spec.Networks)
+	}
+	if len(spec.DNSServers) != 1 || !spec.DNSServers[0].Equal(net.ParseIP("10.89.0.1")) || !reflect.DeepEqual(spec.DNSSearch, []string{"sandbox.internal"}) {
+		t.Errorf("expected DNS settings, got %#v %#v", spec.DNSServers, spec.DNSSearch)
+	}
+	if !reflect.DeepEqual(spec.HostAdd, []string{"db.internal:10.89.0.2"}) {
+		t.Errorf("expected extra hosts, got %#v", spec.HostAdd)
+	}
+	if _, err := PrepareNetwork(*testConfig, false); err == nil {
+		t.Errorf("expected invalid Dns to abort")
+	}
+	testConfig.Run.Dns = []string{"10.89.0.1"}
+	testConfig.Run.ExtraHosts = nil
+	if _, err := PrepareNetwork(*testConfig, false); err != nil {
+		t.Errorf("expected valid network settings, got %v", err)
+	}
+
+	// Parse errors abort the launch instead of changing the network
+	testConfig.Run.Network = "invalid"
+	spec = CreateSpec(*testConfig)
+	if spec.NetNS.NSMode != specgen.None {
+		t.Errorf("expected no network on a parse error, got %#v", spec.NetNS.NSMode)
+	}
+	if _, err := PrepareNetwork(*testConfig, false); err == nil {
+		t.Errorf("expected invalid Network to abort")
+	}
+
+	testConfig.Run.Network = ""
+	testConfig.Run.StaticIP = ""
+	if _, err := PrepareNetwork(*testConfig, false); err == nil {
+		t.Errorf("expected Dns without a network to abort")
+	}
+	// Validated before any network is created
+	testConfig.Run.Networks = []config.ContainerConfigRunNetwork{{Name: "sandbox"}}
+	if err := CreateNetworks(context.Background(), *testConfig, false); err == nil {
+		t.Errorf("expected networks of an invalid configuration not to be created")
+	}
+	testConfig.Run.Networks = nil
+
+	testConfig.Run.Dns = nil
+	testConfig.Run.DnsSearch = nil
+	testConfig.Run.Networks = []config.ContainerConfigRunNetwork{{Name: "sandbox", Subnet: "10.89.0.0/24", Internal: true}}
+	if _, err := PrepareNetwork(*testConfig, false); err != nil {
+		t.Errorf("expected valid networks, got %v", err)
+	}
+	managed, _ := managedNetwork(testConfig.Run.Networks[0])
+	if managed.Name != "sandbox" || !managed.Internal || len(managed.Subnets) != 1 || managed.Subnets[0].Subnet.String() != "10.89.0.0/24" {
+		t.Errorf("expected the declared network, got %#v", managed)
+	}
+	for _, networks := range [][]config.ContainerConfigRunNetwork{{{Subnet: "10.89.0.0/24"}}, {{Name: "a", Subnet: "invalid"}}, {{Name: "a"}, {Name: "a"}}} {
+		testConfig.Run.Networks = networks
+		if _, err := PrepareNetwork(*testConfig, false); err == nil {
+			t.Errorf("expected invalid networks %#v to abort", networks)
+		}
+	}
+}
+
+func TestSshAgent(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/ssh-agent.sock")
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "test"
+	testConfig.Run.SshAgent = true
+	spec := CreateSpec(*testConfig)
+
+	vars := map[string]string{
+		"SSH_AUTH_SOCK": "/tmp/.sandman-ssh-agent",
+	}
+	testMaps(t, vars, spec.Env)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: "/tmp/.sandman-ssh-agent",
+			Source:      "/tmp/ssh-agent.sock",
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+
+	// The allowlist goes through the proxy
+	testConfig.Run.SshAgentKeys = []string{"SHA256:key"}
+	spec = CreateSpec(*testConfig)
+	mountPoints = []specs.Mount{
+		{
+			Destination: "/tmp/.sandman-ssh-agent",
+			Source:      SshAgentProxyPath(*testConfig),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+}
+
+func TestSshAgentProxy(t *testing.T) {
+	agentPath := fmt.Sprintf("%s/agent", t.TempDir())
+	proxyPath := fmt.Sprintf("%s/ssh-agent", t.TempDir())
+	allowedKey := []byte("allowed key")
+	deniedKey := []byte("denied key")
+
+	agent, err := net.Listen("unix", agentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	signed := make(chan []byte, 2)
+	go func() {
+		conn, err := agent.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			request, err := readSshAgentMessage(conn)
+			if err != nil {
+				return
+			}
+			switch request[0] {
+			case sshAgentRequestIdentities:
+				answer := binary.BigEndian.AppendUint32([]byte{sshAgentIdentitiesAnswer}, 2)
+				for _, key := range [][]byte{allowedKey, deniedKey} {
+					answer = appendSshString(answer, key)
+					answer = appendSshString(answer, []byte("comment"))
+				}
+				writeSshAgentMessage(conn, answer)
+			case sshAgentSignRequest:
+				blob, _, _ := parseSshString(request[1:])
+				signed <- blob
+				writeSshAgentMessage(conn, []byte{14})
+			default:
+				writeSshAgentMessage(conn, []byte{6})
+			}
+		}
+	}()
+
+	stop, err := StartSshAgentProxy(agentPath, proxyPath, []string{SshKeyFingerprint(allowedKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	client, err := net.Dial("unix", proxyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	request := func(message []byte) []byte {
+		if err := writeSshAgentMessage(client, message); err != nil {
+			t.Fatal(err)
+		}
+		response, err := readSshAgentMessage(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
 	}
-}
 
-func TestName(t *testing.T) {
-	name := "testing_name_override"
-	testConfig := new(config.ContainerConfig)
-	testConfig.Name = "original_name"
-	testConfig.Run.Name = name
-	spec := CreateSpec(*testConfig)
+	// Only the allowed key is listed
+	answer := request([]byte{sshAgentRequestIdentities})
+	if count := binary.BigEndian.Uint32(answer[1:]); count != 1 {
+		t.Errorf("expected 1 key, got %d", count)
+	}
+	if blob, _, _ := parseSshString(answer[5:]); string(blob) != string(allowedKey) {
+		t.Errorf("expected the allowed key, got %s", blob)
+	}
 
-	if spec.Name != name {
-		t.Errorf("Name incorrect, expected %s, got %s", spec.Name, name)
+	// Signing with a denied key never reaches the agent
+	if response := request(appendSshString([]byte{sshAgentSignRequest}, deniedKey)); response[0] != sshAgentFailure {
+		t.Errorf("expected failure signing with a denied key, got %d", response[0])
 	}
-	if spec.Hostname != name {
-		t.Errorf("Hostname incorrect, expected %s, got %s", spec.Hostname, name)
+	if response := request(appendSshString([]byte{sshAgentSignRequest}, allowedKey)); response[0] != 14 {
+		t.Errorf("expected signature with the allowed key, got %d", response[0])
+	}
+	if blob := <-signed; string(blob) != string(allowedKey) {
+		t.Errorf("expected the agent to sign with the allowed key, got %s", blob)
+	}
+
+	// Key management is refused
+	if response := request([]byte{19}); response[0] != sshAgentFailure {
+		t.Errorf("expected failure removing keys, got %d", response[0])
 	}
 }
 
-func TestPipewire(t *testing.T) {
+func TestTheme(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("GTK_THEME", "Adwaita:dark")
+	os.MkdirAll(fmt.Sprintf("%s/.config/gtk-3.0", home), 0755)
+	os.WriteFile(fmt.Sprintf("%s/.config/gtk-3.0/settings.ini", home), nil, 0644)
+
 	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Pipewire = true
+	testConfig.Run.Theme = true
 	spec := CreateSpec(*testConfig)
 
 	vars := map[string]string{
-		"XDG_RUNTIME_DIR": os.Getenv("XDG_RUNTIME_DIR"),
+		"GTK_THEME": "Adwaita:dark",
 	}
-	testMaps(t, spec.Env, vars)
+	testMaps(t, vars, spec.Env)
 
 	mountPoints := []specs.Mount{
 		{
-			Destination: fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR")),
-			Source:      fmt.Sprintf("%s/pipewire-0", os.Getenv("XDG_RUNTIME_DIR")),
+			Destination: "/home/user/.config/gtk-3.0/settings.ini",
+			Source:      fmt.Sprintf("%s/.config/gtk-3.0/settings.ini", home),
 			Type:        "bind",
+			Options:     []string{"ro"},
 		},
 	}
 	testMountPoints(t, spec, mountPoints)
-}
 
-func TestPorts(t *testing.T) {
-	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Ports = []string{"3000:4000", "invalid"}
-	spec := CreateSpec(*testConfig)
-	ports := []types.PortMapping{
-		{
-			ContainerPort: 3000,
-			HostPort:      4000,
-		},
+	// Missing host paths are skipped
+	for _, mount := range spec.Mounts {
+		if mount.Source == fmt.Sprintf("%s/.local/share/fonts", home) {
+			t.Errorf("unexpected mountpoint for a missing path: %#v", mount)
+		}
 	}
-	testPorts(t, spec, ports)
 }
 
-func TestPulseaudio(t *testing.T) {
+func TestLocale(t *testing.T) {
+	t.Setenv("LANG", "pt_BR.UTF-8")
+	t.Setenv("LC_TIME", "en_GB.UTF-8")
+
 	testConfig := new(config.ContainerConfig)
-	testConfig.Run.Pulseaudio = true
+	testConfig.Run.Locale = true
 	spec := CreateSpec(*testConfig)
 
 	vars := map[string]string{
-		"XDG_RUNTIME_DIR": os.Getenv("XDG_RUNTIME_DIR"),
-	}
-	testMaps(t, spec.Env, vars)
-
-	mountPoints := []specs.Mount{
-		{
-			Destination: "/etc/machine-id",
-			Source:      "/etc/machine-id",
-			Type:        "bind",
-			Options:     []string{"ro"},
-		},
-		{
-			Destination: fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
-			Source:      fmt.Sprintf("%s/pulse/native", os.Getenv("XDG_RUNTIME_DIR")),
-			Type:        "bind",
-		},
+		"LANG":    "pt_BR.UTF-8",
+		"LC_TIME": "en_GB.UTF-8",
 	}
-	testMountPoints(t, spec, mountPoints)
+	testMaps(t, vars, spec.Env)
 }
 
-func TestNetwork(t *testing.T) {
+func TestTimezone(t *testing.T) {
 	testConfig := new(config.ContainerConfig)
-	var ns specgen.Namespace
+	testConfig.Run.Timezone = true
 
-	testConfig.Run.Net = true
-	testConfig.Run.Network = ""
+	t.Setenv("TZ", "America/Sao_Paulo")
 	spec := CreateSpec(*testConfig)
-	ns.NSMode = specgen.Slirp
-	if spec.NetNS.NSMode != ns.NSMode {
-		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
-	}
-
-	testConfig.Run.Net = false
-	testConfig.Run.Network = ""
-	spec = CreateSpec(*testConfig)
-	ns.NSMode = specgen.None
-	if spec.NetNS.NSMode != ns.NSMode {
-		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
-	}
-
-	testConfig.Run.Net = false
-	testConfig.Run.Network = "host"
-	spec = CreateSpec(*testConfig)
-	ns, _, _, _ = specgen.ParseNetworkFlag([]string{"host"})
-	if spec.NetNS.NSMode != ns.NSMode {
-		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
+	if spec.Env["TZ"] != "America/Sao_Paulo" {
+		t.Errorf("TZ incorrect, expected %s, got %s", "America/Sao_Paulo", spec.Env["TZ"])
 	}
 
-	testConfig.Run.Net = false
-	testConfig.Run.Network = "other"
+	os.Unsetenv("TZ")
 	spec = CreateSpec(*testConfig)
-	ns.NSMode = specgen.Bridge
-	if spec.NetNS.NSMode != ns.NSMode {
-		t.Errorf("Network namespace incorrect, expected %#v, got %#v", ns.NSMode, spec.NetNS.NSMode)
+	if spec.Env["TZ"] != ":/etc/localtime" {
+		t.Errorf("TZ incorrect, expected %s, got %s", ":/etc/localtime", spec.Env["TZ"])
 	}
 }
 
@@ -333,6 +2052,183 @@ func TestUidmap(t *testing.T) {
 	}
 }
 
+func TestParseUsbSelector(t *testing.T) {
+	selectors := map[string]UsbSelector{
+		"1050:0407":                         {Vendor: "1050", Product: "0407"},
+		"1050":                              {Vendor: "1050"},
+		"vendor=0403,serial=A12345":         {Vendor: "0403", Serial: "A12345"},
+		"path=1-2.3":                        {Path: "1-2.3"},
+		"class=hid":                         {Class: "03"},
+		"class=0B, subsystem=hidraw":        {Class: "0b", Subsystem: "hidraw"},
+		"vendor=046d,product=c52b,class=ff": {Vendor: "046d", Product: "c52b", Class: "ff"},
+	}
+	for selector, expected := range selectors {
+		s, err := ParseUsbSelector(selector)
+		if err != nil || s != expected {
+			t.Errorf("selector %s incorrect, expected %#v, got %#v (%v)", selector, expected, s, err)
+		}
+	}
+
+	for _, selector := range []string{"vendor=", "color=red", "class=keyboard"} {
+		if _, err := ParseUsbSelector(selector); err == nil {
+			t.Errorf("expected selector %s to be invalid", selector)
+		}
+	}
+}
+
+func TestUsbSelectorMatch(t *testing.T) {
+	devpath := fmt.Sprintf("%s/1-2.3", t.TempDir())
+	os.MkdirAll(fmt.Sprintf("%s/1-2.3:1.0", devpath), 0755)
+	os.WriteFile(fmt.Sprintf("%s/1-2.3:1.0/bInterfaceClass", devpath), []byte("03\n"), 0644)
+
+	dev := &udevtypes.Device{
+		Devpath: devpath,
+		Env:     map[string]string{"DEVNAME": "bus/usb/001/004"},
+		Attrs: map[string]string{
+			"idVendor":     "1050",
+			"idProduct":    "0407",
+			"serial":       "123456",
+			"bDeviceClass": "00",
+		},
+		Children: []*udevtypes.Device{
+			{
+				Env: map[string]string{"SUBSYSTEM": "usb", "DEVTYPE": "usb_interface"},
+				Children: []*udevtypes.Device{
+					{Env: map[string]string{"DEVNAME": "hidraw0", "SUBSYSTEM": "hidraw"}},
+				},
+			},
+		},
+	}
+
+	matching := []UsbSelector{
+		{},
+		{Vendor: "1050", Product: "0407"},
+		{Serial: "123456"},
+		{Path: "1-2.3"},
+		{Class: "03"},
+		{Subsystem: "hidraw"},
+	}
+	for _, s := range matching {
+		if !s.Match(dev) {
+			t.Errorf("expected %#v to match", s)
+		}
+	}
+
+	notMatching := []UsbSelector{
+		{Vendor: "1050", Product: "0010"},
+		{Serial: "654321"},
+		{Path: "1-2"},
+		{Class: "08"},
+		{Subsystem: "tty"},
+	}
+	for _, s := range notMatching {
+		if s.Match(dev) {
+			t.Errorf("expected %#v not to match", s)
+		}
+	}
+
+	paths := extractDevicePaths(dev)
+	if !reflect.DeepEqual(paths, []string{"/dev/bus/usb/001/004", "/dev/hidraw0"}) {
+		t.Errorf("device paths incorrect, got %#v", paths)
+	}
+}
+
+func TestUsbHotplug(t *testing.T) {
+	// The layout of a usb security key, the hidraw node is below the HID device of the interface
+	const devpath = "/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/0003:1050:0407.0001/hidraw/hidraw3"
+	event := ParseUevent([]byte("add@" + devpath + "\x00ACTION=add\x00DEVPATH=" + devpath + "\x00SUBSYSTEM=hidraw\x00MAJOR=242\x00MINOR=3\x00DEVNAME=hidraw3\x00"))
+	vars := map[string]string{
+		"ACTION":    "add",
+		"SUBSYSTEM": "hidraw",
+		"MAJOR":     "242",
+		"MINOR":     "3",
+		"DEVNAME":   "hidraw3",
+	}
+	testMaps(t, vars, event)
+
+	// Only kernel events
+	if len(ParseUevent([]byte("libudev\x00ACTION=add"))) != 0 {
+		t.Errorf("expected udev events to be ignored")
+	}
+
+	sysfs := t.TempDir()
+	usbDevice := fmt.Sprintf("%s/devices/pci0000:00/0000:00:14.0/usb1/1-2", sysfs)
+	os.MkdirAll(sysfs+devpath, 0755)
+	os.WriteFile(usbDevice+"/idVendor", []byte("1050\n"), 0644)
+	os.WriteFile(usbDevice+"/idProduct", []byte("0407\n"), 0644)
+	os.WriteFile(usbDevice+"/1-2:1.0/bInterfaceClass", []byte("03\n"), 0644)
+	os.WriteFile(fmt.Sprintf("%s/devices/pci0000:00/0000:00:14.0/usb1/idVendor", sysfs), []byte("1d6b\n"), 0644)
+
+	// The container /dev links outside its root, nodes must stay inside
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Symlink(outside, root+"/dev")
+	os.MkdirAll(root+outside, 0755)
+
+	var updates [][]specs.LinuxDeviceCgroup
+	h := &usbHotplug{
+		root:      root,
+		sysfsRoot: sysfs,
+		selectors: []UsbSelector{{Vendor: "0403"}},
+		nodes:     map[string]string{},
+		baseRules: []specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}},
+		rules:     map[string]specs.LinuxDeviceCgroup{},
+		update: func(rules []specs.LinuxDeviceCgroup) error {
+			updates = append(updates, rules)
+			return nil
+		},
+	}
+	if h.matches(event) {
+		t.Errorf("expected hidraw node of 1050:0407 not to match 0403")
+	}
+	if err := h.handle(event); err != nil || len(h.nodes) != 0 || len(updates) != 0 {
+		t.Errorf("expected nothing for a device not matching, got %#v (%v)", h.nodes, err)
+	}
+
+	h.selectors = []UsbSelector{{Vendor: "1050", Class: "03", Subsystem: "hidraw"}}
+	if !h.matches(event) {
+		t.Fatalf("expected hidraw node of 1050:0407 to match")
+	}
+	err := h.handle(event)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("creating device nodes needs CAP_MKNOD")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 1 || len(updates[0]) != 2 {
+		t.Fatalf("expected the device to be allowed, got %#v", updates)
+	}
+	rule := updates[0][1]
+	if !rule.Allow || rule.Type != "c" || *rule.Major != 242 || *rule.Minor != 3 || rule.Access != "rw" {
+		t.Errorf("expected only c 242:3 rw, got %#v", rule)
+	}
+	if _, err := os.Lstat(outside + "/hidraw3"); err == nil {
+		t.Errorf("expected the node not to follow the container symlink")
+	}
+	if _, err := os.Lstat(root + outside + "/hidraw3"); err != nil {
+		t.Errorf("expected the node inside the container root: %v", err)
+	}
+
+	// Block devices are never added
+	blockEvent := map[string]string{"ACTION": "add", "DEVPATH": devpath, "SUBSYSTEM": "block", "MAJOR": "8", "MINOR": "0", "DEVNAME": "sda"}
+	if err := h.handle(blockEvent); err != nil || len(updates) != 1 {
+		t.Errorf("expected block devices to be ignored, got %#v (%v)", updates, err)
+	}
+
+	event["ACTION"] = "remove"
+	if err := h.handle(event); err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || len(updates[1]) != 1 || len(h.nodes) != 0 {
+		t.Errorf("expected the device to be revoked, got %#v", updates)
+	}
+	if _, err := os.Lstat(root + outside + "/hidraw3"); err == nil {
+		t.Errorf("expected the node to be removed")
+	}
+}
+
 func TestVolumes(t *testing.T) {
 	testConfig := new(config.ContainerConfig)
 	testConfig.Run.Volumes = []string{"/vol1", "/vol2:/vol3", "/vol4:/vol5:ro,atime"}
@@ -380,25 +2276,391 @@ func TestWayland(t *testing.T) {
 	testMountPoints(t, spec, mountPoints)
 }
 
+type fakeCompositorResult struct {
+	appID string
+	fds   int
+}
+
+// Serves a single client, advertising the security context manager if requested
+func fakeCompositor(t *testing.T, advertise bool) (string, chan fakeCompositorResult) {
+	path := fmt.Sprintf("%s/wayland-test", t.TempDir())
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan fakeCompositorResult, 1)
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var result fakeCompositorResult
+		var registry uint32
+		var pending []byte
+		w := &waylandConn{conn: conn}
+		buf := make([]byte, 4096)
+		oob := make([]byte, 4096)
+
+		for {
+			n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+			if err != nil {
+				results <- result
+				return
+			}
+			if messages, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+				for _, message := range messages {
+					fds, _ := syscall.ParseUnixRights(&message)
+					result.fds += len(fds)
+					for _, fd := range fds {
+						syscall.Close(fd)
+					}
+				}
+			}
+
+			pending = append(pending, buf[:n]...)
+			for len(pending) >= 8 {
+				object := binary.NativeEndian.Uint32(pending)
+				size := binary.NativeEndian.Uint32(pending[4:]) >> 16
+				opcode := binary.NativeEndian.Uint32(pending[4:]) & 0xffff
+				args := pending[8:size]
+				pending = pending[size:]
+
+				switch {
+				case object == waylandDisplayID && opcode == waylandDisplayGetRegistry:
+					registry, _, _ = parseWaylandUint(args)
+				case object == waylandDisplayID && opcode == waylandDisplaySync:
+					callback, _, _ := parseWaylandUint(args)
+					if advertise && registry != 0 {
+						global := waylandUint(7)
+						global = append(global, waylandString(securityContextManagerInterface)...)
+						global = append(global, waylandUint(1)...)
+						w.send(registry, waylandRegistryGlobal, global)
+						registry = 0
+					}
+					w.send(callback, waylandCallbackDone, waylandUint(0))
+				case opcode == securityContextSetAppID && result.fds > 0 && result.appID == "":
+					result.appID, _, _ = parseWaylandString(args)
+				}
+			}
+		}
+	}()
+
+	return path, results
+}
+
+func TestCreateSecurityContext(t *testing.T) {
+	compositor, results := fakeCompositor(t, true)
+	listenPath := fmt.Sprintf("%s/wayland-sandbox", t.TempDir())
+
+	stop, err := CreateSecurityContext(compositor, listenPath, "app")
+	if err != nil {
+		t.Fatalf("failed to create security context: %s", err)
+	}
+	if _, err := os.Stat(listenPath); err != nil {
+		t.Errorf("expected listening socket at %s", listenPath)
+	}
+	stop()
+
+	result := <-results
+	if result.fds != 2 {
+		t.Errorf("expected listen and close fds, got %d fds", result.fds)
+	}
+	if result.appID != "app" {
+		t.Errorf("app id incorrect, expected %s, got %s", "app", result.appID)
+	}
+	if _, err := os.Stat(listenPath); err == nil {
+		t.Errorf("expected listening socket to be removed")
+	}
+}
+
+func TestCreateSecurityContextUnsupported(t *testing.T) {
+	compositor, _ := fakeCompositor(t, false)
+	listenPath := fmt.Sprintf("%s/wayland-sandbox", t.TempDir())
+
+	if _, err := CreateSecurityContext(compositor, listenPath, "app"); err != ErrSecurityContextUnsupported {
+		t.Errorf("expected unsupported error, got %v", err)
+	}
+
+	// Falls back to the compositor socket
+	compositor, _ = fakeCompositor(t, false)
+	runtimeDir, display := filepath.Split(compositor)
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Clean(runtimeDir))
+	t.Setenv("WAYLAND_DISPLAY", display)
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "name"
+	testConfig.Run.Wayland = true
+	testConfig.Run.WaylandSecurityContext = true
+	if _, err := PrepareWayland(*testConfig, false); err != nil {
+		t.Errorf("unexpected error without a security context: %v", err)
+	}
+	if target, err := os.Readlink(WaylandSocketPath(*testConfig)); err != nil || target != compositor {
+		t.Errorf("expected the sandbox socket to link to %s, got %s (%v)", compositor, target, err)
+	}
+}
+
+func TestWaylandSecurityContext(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "name"
+	testConfig.Run.Wayland = true
+	testConfig.Run.WaylandSecurityContext = true
+	spec := CreateSpec(*testConfig)
+
+	mountPoints := []specs.Mount{
+		{
+			Destination: fmt.Sprintf("%s/%s", os.Getenv("XDG_RUNTIME_DIR"), os.Getenv("WAYLAND_DISPLAY")),
+			Source:      fmt.Sprintf("%s/wayland", config.GetSandboxRuntimeDir("name")),
+			Type:        "bind",
+		},
+	}
+	testMountPoints(t, spec, mountPoints)
+}
+
 func TestX11(t *testing.T) {
+	t.Setenv("DISPLAY", ":1.0")
 	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "name"
 	testConfig.Run.X11 = true
 	spec := CreateSpec(*testConfig)
 
 	vars := map[string]string{
 		"XDG_SESSION_TYPE": os.Getenv("XDG_SESSION_TYPE"),
-		"DISPLAY":          os.Getenv("DISPLAY"),
+		"DISPLAY":          ":1.0",
 		"XCURSOR_THEME":    os.Getenv("XCURSOR_THEME"),
 		"XCURSOR_SIZE":     os.Getenv("XCURSOR_SIZE"),
+		"XAUTHORITY":       xauthorityDestination,
 	}
-	testMaps(t, spec.Env, vars)
+	testMaps(t, vars, spec.Env)
 
 	mountPoints := []specs.Mount{
 		{
-			Destination: "/tmp/.X11-unix",
-			Source:      "/tmp/.X11-unix",
+			Destination: "/tmp/.X11-unix/X1",
+			Source:      "/tmp/.X11-unix/X1",
+			Type:        "bind",
+		},
+		{
+			Destination: xauthorityDestination,
+			Source:      fmt.Sprintf("%s/Xauthority", config.GetSandboxRuntimeDir("name")),
 			Type:        "bind",
+			Options:     []string{"ro"},
 		},
 	}
 	testMountPoints(t, spec, mountPoints)
 }
+
+// A display answering the SECURITY requests, recording the setup authentication and revoked ids
+func x11TestServer(t *testing.T, security bool) (string, chan []byte, chan uint32) {
+	listener, err := net.Listen("unix", fmt.Sprintf("%s/X7", x11SocketDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	auths := make(chan []byte, 4)
+	revoked := make(chan uint32, 4)
+	go serveListener(listener, func(conn net.Conn) {
+		defer conn.Close()
+		setup := make([]byte, 12)
+		if _, err := io.ReadFull(conn, setup); err != nil {
+			return
+		}
+		name := make([]byte, int(binary.LittleEndian.Uint16(setup[6:])+3)/4*4)
+		data := make([]byte, int(binary.LittleEndian.Uint16(setup[8:])+3)/4*4)
+		io.ReadFull(conn, name)
+		io.ReadFull(conn, data)
+		auths <- data[:binary.LittleEndian.Uint16(setup[8:])]
+		conn.Write([]byte{1, 0, 11, 0, 0, 0, 0, 0})
+
+		for {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			body := make([]byte, int(binary.LittleEndian.Uint16(header[2:]))*4-4)
+			io.ReadFull(conn, body)
+
+			reply := make([]byte, 32)
+			reply[0] = 1
+			switch {
+			case header[0] == x11QueryExtension:
+				if security {
+					reply[8], reply[9] = 1, 130
+				}
+			case header[0] == 130 && header[1] == x11SecurityGenerateAuthorization:
+				binary.LittleEndian.PutUint32(reply[4:], 4)
+				binary.LittleEndian.PutUint32(reply[8:], 42)
+				binary.LittleEndian.PutUint16(reply[12:], 16)
+				reply = append(reply, bytes.Repeat([]byte{0xab}, 16)...)
+			case header[0] == 130 && header[1] == x11SecurityRevokeAuthorization:
+				revoked <- binary.LittleEndian.Uint32(body)
+				continue
+			}
+			conn.Write(reply)
+		}
+	})
+	return ":7", auths, revoked
+}
+
+func TestPrepareX11(t *testing.T) {
+	if _, err := exec.LookPath("xauth"); err != nil {
+		t.Skip("xauth is not installed")
+	}
+	dir := t.TempDir()
+	x11SocketDir = dir
+	defer func() { x11SocketDir = "/tmp/.X11-unix" }()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	t.Setenv("XAUTHORITY", fmt.Sprintf("%s/host-Xauthority", dir))
+	if err := exec.Command("xauth", "-q", "add", ":7", x11CookieName, "00112233445566778899aabbccddeeff").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	display, auths, revoked := x11TestServer(t, true)
+	t.Setenv("DISPLAY", display)
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "name"
+	testConfig.Run.X11 = true
+
+	revoke, err := PrepareX11(*testConfig, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := <-auths; hex.EncodeToString(auth) != "00112233445566778899aabbccddeeff" {
+		t.Errorf("expected the host cookie to authenticate, got %x", auth)
+	}
+
+	// Only the generated cookie, for any host
+	output, err := exec.Command("xauth", "-f", XauthorityPath(*testConfig), "nlist").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := xauthEntry("7", x11CookieName, bytes.Repeat([]byte{0xab}, 16)); string(output) != expected {
+		t.Errorf("Xauthority incorrect, expected %q, got %q", expected, output)
+	}
+
+	if revoke == nil {
+		t.Fatal("expected the untrusted cookie to be revoked on exit")
+	}
+	revoke()
+	if id := <-revoked; id != 42 {
+		t.Errorf("expected cookie 42 to be revoked, got %d", id)
+	}
+}
+
+func TestPrepareX11Untrusted(t *testing.T) {
+	dir := t.TempDir()
+	x11SocketDir = dir
+	defer func() { x11SocketDir = "/tmp/.X11-unix" }()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	t.Setenv("XAUTHORITY", fmt.Sprintf("%s/host-Xauthority", dir))
+	if err := exec.Command("xauth", "-q", "add", ":7", x11CookieName, "00112233445566778899aabbccddeeff").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the SECURITY extension the host cookie is shared instead
+	display, auths, _ := x11TestServer(t, false)
+	t.Setenv("DISPLAY", display)
+	testConfig := new(config.ContainerConfig)
+	testConfig.Name = "name"
+	testConfig.Run.X11 = true
+	revoke, err := PrepareX11(*testConfig, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-auths
+	if revoke != nil {
+		t.Errorf("expected no cookie to revoke")
+	}
+	output, err := exec.Command("xauth", "-f", XauthorityPath(*testConfig), "nlist").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(output), "ffff ") || !strings.HasSuffix(string(output), " 00112233445566778899aabbccddeeff\n") {
+		t.Errorf("expected the host cookie for any host, got %q", output)
+	}
+
+	// Unless a restricted clipboard relies on it
+	for _, mode := range []string{ClipboardNone, ClipboardRead, ClipboardWrite} {
+		testConfig.Run.Clipboard = mode
+		if _, err := PrepareX11(*testConfig, false); err == nil {
+			t.Errorf("expected Clipboard %s without the SECURITY extension to abort", mode)
+		}
+		<-auths
+	}
+	testConfig.Run.Clipboard = ClipboardBoth
+	if _, err := PrepareX11(*testConfig, false); err != nil {
+		t.Errorf("expected Clipboard both to fall back to the host cookie, got %v", err)
+	}
+	<-auths
+
+	testConfig.Run.Clipboard = ClipboardRead
+	t.Setenv("DISPLAY", "host:0")
+	if _, err := PrepareX11(*testConfig, false); err == nil {
+		t.Errorf("expected a remote display with a restricted clipboard to abort")
+	}
+}
+
+func TestX11DisplayNumber(t *testing.T) {
+	displays := map[string]string{
+		":0":       "0",
+		":1.0":     "1",
+		"unix:2":   "2",
+		"host:0":   "",
+		"":         "",
+		"invalid:": "",
+	}
+
+	for display, expected := range displays {
+		number, local := X11DisplayNumber(display)
+		if number != expected || local != (expected != "") {
+			t.Errorf("display number incorrect for %s, expected %s, got %s", display, expected, number)
+		}
+	}
+}
+
+func TestPrepareUsbHotplug(t *testing.T) {
+	defer func() { hostEuid = os.Geteuid }()
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.UsbHotplug = true
+
+	hostEuid = func() int { return 1000 }
+	if _, err := PrepareUsbHotplug(*testConfig, false); err != nil {
+		t.Errorf("unexpected error without usb devices: %v", err)
+	}
+	testConfig.Run.UsbDevices = []string{"1050:0407"}
+	if _, err := PrepareUsbHotplug(*testConfig, false); err == nil {
+		t.Errorf("expected rootless usb hotplug to fail")
+	}
+
+	hostEuid = func() int { return 0 }
+	if _, err := PrepareUsbHotplug(*testConfig, false); err != nil {
+		t.Errorf("unexpected error as root: %v", err)
+	}
+}
+
+func TestStartedHelpers(t *testing.T) {
+	testConfig := new(config.ContainerConfig)
+	testConfig.Run.HostServices = []string{"unix:/run/service.sock"}
+	testConfig.Run.UsbDevices = []string{"1050:0407"}
+	if startedHelpers(*testConfig) {
+		t.Errorf("unexpected started helpers without egress, TCP host services or usb hotplug")
+	}
+
+	for _, set := range []func(c *config.ContainerConfig){
+		func(c *config.ContainerConfig) { c.Run.Egress = []string{"example.com:443"} },
+		func(c *config.ContainerConfig) { c.Run.HostServices = append(c.Run.HostServices, "tcp:localhost:5432") },
+		func(c *config.ContainerConfig) { c.Run.UsbHotplug = true },
+	} {
+		helperConfig := *testConfig
+		set(&helperConfig)
+		if !startedHelpers(helperConfig) {
+			t.Errorf("expected started helpers for %#v", helperConfig.Run)
+		}
+	}
+
+	if output := captureOutput(func() { fmt.Println("held back") }); string(output) != "held back\n" {
+		t.Errorf("captured output incorrect, got %q", output)
+	}
+}
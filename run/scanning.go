@@ -0,0 +1,27 @@
+package run
+
+import (
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+)
+
+const saneConfigDir = "/etc/sane.d"
+
+// The host backend configuration, mounted at saneConfigDir
+var saneHostConfigDir = saneConfigDir
+
+// Most usb scanners use the still image class
+var defaultScannerDevices = []string{"class=06"}
+
+func Scanning(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.Scanning {
+		var selectors []string = containerConfig.Run.ScannerDevices
+		if len(selectors) == 0 {
+			selectors = defaultScannerDevices
+		}
+		addUsbDevices(spec, selectors)
+
+		// Backend configuration, including the network scanners of the net and escl backends
+		mountReadOnlyIfExists(spec, saneHostConfigDir, saneConfigDir)
+	}
+}
@@ -0,0 +1,35 @@
+package run
+
+// Shell scripts injected into the container to reach host side listeners. Images may lack any client
+// for unix sockets, so send() uses the first one available.
+
+const shimSocketClient = `
+send() {
+	if command -v socat >/dev/null 2>&1; then
+		socat - "UNIX-CONNECT:$socket"
+	elif command -v python3 >/dev/null 2>&1; then
+		python3 -c 'import socket, sys
+s = socket.socket(socket.AF_UNIX)
+s.connect(sys.argv[1])
+s.sendall(sys.stdin.buffer.read())
+s.shutdown(socket.SHUT_WR)
+while True:
+    data = s.recv(65536)
+    if not data:
+        break
+    sys.stdout.buffer.write(data)' "$socket"
+	elif command -v perl >/dev/null 2>&1; then
+		perl -MIO::Socket::UNIX -e 'binmode STDIN; binmode STDOUT; $s = IO::Socket::UNIX->new(Peer => $ARGV[0]) or die "$!\n"; print $s $_ while <STDIN>; shutdown($s, 1); print while <$s>' "$socket"
+	elif command -v nc >/dev/null 2>&1; then
+		nc -U -N "$socket"
+	else
+		echo "socat, python3, perl or nc is needed to reach the host" >&2
+		exit 1
+	fi
+}
+`
+
+// Starts a shim talking to the socket mounted at socketDestination
+func shimHeader(socketDestination string) string {
+	return "#!/bin/sh\n# Generated by sandman\nsocket=" + socketDestination + "\n" + shimSocketClient
+}
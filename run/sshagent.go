@@ -0,0 +1,64 @@
+package run
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const sshAgentDestination = "/tmp/.sandman-ssh-agent"
+
+func SshAgentProxyPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/ssh-agent", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
+func SshAgent(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.SshAgent {
+		var source string = os.Getenv("SSH_AUTH_SOCK")
+		if len(containerConfig.Run.SshAgentKeys) > 0 {
+			source = SshAgentProxyPath(containerConfig)
+		}
+
+		spec.Env["SSH_AUTH_SOCK"] = sshAgentDestination
+		spec.Mounts = append(spec.Mounts,
+			specs.Mount{
+				Destination: sshAgentDestination,
+				Source:      source,
+				Type:        "bind",
+			},
+		)
+	}
+}
+
+func PrepareSshAgent(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if !containerConfig.Run.SshAgent {
+		return nil, nil
+	}
+
+	var agentSocket string = os.Getenv("SSH_AUTH_SOCK")
+	if agentSocket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set, is the ssh agent running?")
+	}
+
+	if len(containerConfig.Run.SshAgentKeys) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+
+	stop, err := StartSshAgentProxy(agentSocket, SshAgentProxyPath(containerConfig), containerConfig.Run.SshAgentKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if verbose {
+		fmt.Println("SSH agent proxy: ", SshAgentProxyPath(containerConfig))
+	}
+
+	return stop, nil
+}
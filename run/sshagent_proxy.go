@@ -0,0 +1,157 @@
+package run
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+)
+
+// SSH agent protocol proxy that only lists and signs with the allowed keys, and refuses anything else
+
+const (
+	sshAgentMaxMessageSize = 256 * 1024
+
+	sshAgentFailure           = 5
+	sshAgentRequestIdentities = 11
+	sshAgentIdentitiesAnswer  = 12
+	sshAgentSignRequest       = 13
+)
+
+// Same format as ssh-keygen -l
+func SshKeyFingerprint(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func readSshAgentMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > sshAgentMaxMessageSize {
+		return nil, fmt.Errorf("invalid ssh agent message size: %d", length)
+	}
+
+	message := make([]byte, length)
+	_, err := io.ReadFull(r, message)
+	return message, err
+}
+
+func writeSshAgentMessage(w io.Writer, message []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(message))), message...))
+	return err
+}
+
+func parseSshString(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint32(len(data)-4) < length {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return data[4 : 4+length], data[4+length:], nil
+}
+
+func appendSshString(data []byte, value []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+	return append(data, value...)
+}
+
+// Removes the keys that aren't allowed from an identities answer
+func filterSshIdentities(answer []byte, allowed []string) ([]byte, error) {
+	if len(answer) < 5 || answer[0] != sshAgentIdentitiesAnswer {
+		return answer, nil
+	}
+
+	var count uint32
+	var keys []byte
+	data := answer[5:]
+	for i := binary.BigEndian.Uint32(answer[1:]); i > 0; i-- {
+		blob, rest, err := parseSshString(data)
+		if err != nil {
+			return nil, err
+		}
+		comment, rest, err := parseSshString(rest)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		if slices.Contains(allowed, SshKeyFingerprint(blob)) {
+			count++
+			keys = appendSshString(keys, blob)
+			keys = appendSshString(keys, comment)
+		}
+	}
+
+	filtered := binary.BigEndian.AppendUint32([]byte{sshAgentIdentitiesAnswer}, count)
+	return append(filtered, keys...), nil
+}
+
+// Only listing keys and signing with the allowed ones reach the agent
+func sshAgentRequestAllowed(request []byte, allowed []string) bool {
+	switch request[0] {
+	case sshAgentRequestIdentities:
+		return true
+	case sshAgentSignRequest:
+		blob, _, err := parseSshString(request[1:])
+		return err == nil && slices.Contains(allowed, SshKeyFingerprint(blob))
+	}
+	return false
+}
+
+func proxySshAgentClient(client net.Conn, agentSocket string, allowed []string) {
+	defer client.Close()
+
+	agent, err := net.Dial("unix", agentSocket)
+	if err != nil {
+		fmt.Println("SSH agent proxy can't connect to the agent: ", err)
+		return
+	}
+	defer agent.Close()
+
+	// The protocol is strictly request and response
+	for {
+		request, err := readSshAgentMessage(client)
+		if err != nil {
+			return
+		}
+
+		if !sshAgentRequestAllowed(request, allowed) {
+			if err := writeSshAgentMessage(client, []byte{sshAgentFailure}); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err := writeSshAgentMessage(agent, request); err != nil {
+			return
+		}
+		response, err := readSshAgentMessage(agent)
+		if err != nil {
+			return
+		}
+		if request[0] == sshAgentRequestIdentities {
+			if response, err = filterSshIdentities(response, allowed); err != nil {
+				return
+			}
+		}
+		if err := writeSshAgentMessage(client, response); err != nil {
+			return
+		}
+	}
+}
+
+// Forwards the clients on listenPath to the agent socket, restricted to the allowed keys
+func StartSshAgentProxy(agentSocket string, listenPath string, allowed []string) (func(), error) {
+	return startSandboxSocket(listenPath, func(client net.Conn) {
+		proxySshAgentClient(client, agentSocket, allowed)
+	})
+}
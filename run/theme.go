@@ -0,0 +1,79 @@
+package run
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var (
+	themeSystemPaths = []string{
+		"/usr/share/icons",
+		"/usr/share/themes",
+		"/etc/fonts",
+	}
+
+	// Relative to the home directory, mounted into the container home
+	themeUserPaths = []string{
+		".config/gtk-3.0/settings.ini",
+		".config/gtk-4.0/settings.ini",
+		".gtkrc-2.0",
+		".config/qt5ct",
+		".config/qt6ct",
+		".config/kdeglobals",
+		".config/fontconfig",
+		".local/share/fonts",
+		".local/share/icons",
+		".local/share/themes",
+		".icons",
+	}
+
+	themeEnv = []string{
+		"GTK_THEME",
+		"QT_QPA_PLATFORMTHEME",
+		"QT_STYLE_OVERRIDE",
+		"XCURSOR_THEME",
+		"XCURSOR_SIZE",
+	}
+)
+
+// Mounts a host path read-only, skipping the ones missing on the host
+func mountReadOnlyIfExists(spec *specgen.SpecGenerator, source string, destination string) {
+	if _, err := os.Stat(source); err != nil {
+		return
+	}
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: destination,
+		Source:      source,
+		Type:        "bind",
+		Options:     []string{"ro"},
+	})
+}
+
+// Copies the host environment variables that are set
+func passEnv(spec *specgen.SpecGenerator, names ...string) {
+	for _, name := range names {
+		if value, exists := os.LookupEnv(name); exists {
+			spec.Env[name] = value
+		}
+	}
+}
+
+func Theme(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.Theme {
+		for _, path := range themeSystemPaths {
+			mountReadOnlyIfExists(spec, path, path)
+		}
+
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, path := range themeUserPaths {
+				mountReadOnlyIfExists(spec, filepath.Join(home, path), filepath.Join(containerHomeDir(containerConfig), path))
+			}
+		}
+
+		passEnv(spec, themeEnv...)
+	}
+}
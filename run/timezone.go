@@ -0,0 +1,25 @@
+package run
+
+import (
+	"os"
+
+	"github.com/containers/podman/v6/pkg/specgen"
+	"github.com/julioln/sandman/config"
+)
+
+const localtimePath = "/etc/localtime"
+
+// The image may lack the zoneinfo database, so the host localtime is used unless TZ is set
+func hostTimezone() string {
+	if tz, exists := os.LookupEnv("TZ"); exists {
+		return tz
+	}
+	return ":" + localtimePath
+}
+
+func Timezone(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
+	if containerConfig.Run.Timezone {
+		spec.Env["TZ"] = hostTimezone()
+		mountReadOnlyIfExists(spec, localtimePath, localtimePath)
+	}
+}
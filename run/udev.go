@@ -0,0 +1,65 @@
+package run
+
+import (
+	"fmt"
+
+	"github.com/citilinkru/libudev"
+	"github.com/citilinkru/libudev/matcher"
+	"github.com/citilinkru/libudev/types"
+)
+
+// Reads the devices from sysfs, replaced in tests
+var scanDevices = func() ([]*types.Device, error) {
+	sc := libudev.NewScanner()
+	err, devices := sc.ScanDevices()
+	return devices, err
+}
+
+// Devices matching every rule
+func matchDevices(devices []*types.Device, rules ...matcher.Rule) []*types.Device {
+	m := matcher.NewMatcher()
+	m.SetStrategy(matcher.StrategyAnd)
+	for _, rule := range rules {
+		m.AddRule(rule)
+	}
+	return m.Match(devices)
+}
+
+// The device a node belongs to, its HID device or else its usb interface. Input and hidraw nodes have different
+// parents (inputNN and the HID device), but share the HID device, over usb and bluetooth alike
+func physicalDevice(dev *types.Device) *types.Device {
+	for parent := dev.Parent; parent != nil; parent = parent.Parent {
+		if parent.Env["SUBSYSTEM"] == "hid" || parent.Env["DEVTYPE"] == "usb_interface" {
+			return parent
+		}
+	}
+	return nil
+}
+
+// Nodes of the subsystem belonging to the same device as any of the nodes, e.g. the media node of a camera
+func siblingDevices(devices []*types.Device, nodes []*types.Device, subsystem string) []*types.Device {
+	var siblings []*types.Device
+	for _, dev := range matchDevices(devices, matcher.NewRuleEnv("SUBSYSTEM", fmt.Sprintf("^%s$", subsystem))) {
+		physical := physicalDevice(dev)
+		if physical == nil {
+			continue
+		}
+		for _, node := range nodes {
+			if physicalDevice(node) == physical {
+				siblings = append(siblings, dev)
+				break
+			}
+		}
+	}
+	return siblings
+}
+
+func devicePaths(devices []*types.Device) []string {
+	var paths []string
+	for _, dev := range devices {
+		if devname, exists := dev.Env["DEVNAME"]; exists {
+			paths = append(paths, fmt.Sprintf("/dev/%s", devname))
+		}
+	}
+	return paths
+}
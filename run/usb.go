@@ -2,9 +2,12 @@ package run
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"text/tabwriter"
 
-	"github.com/citilinkru/libudev"
 	"github.com/citilinkru/libudev/matcher"
 	"github.com/citilinkru/libudev/types"
 	"github.com/containers/podman/v6/pkg/specgen"
@@ -12,10 +15,135 @@ import (
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+// Interface class names accepted by the class selector
+var usbClasses = map[string]string{
+	"audio":     "01",
+	"cdc":       "02",
+	"hid":       "03",
+	"printer":   "07",
+	"storage":   "08",
+	"hub":       "09",
+	"cdc-data":  "0a",
+	"smartcard": "0b",
+	"video":     "0e",
+	"wireless":  "e0",
+	"vendor":    "ff",
+}
+
+// Selects usb devices, every field set must match
+type UsbSelector struct {
+	Vendor    string
+	Product   string
+	Serial    string
+	Path      string
+	Class     string
+	Subsystem string
+}
+
+// Parses vendor[:product] or a comma separated list of key=value pairs, e.g.
+// vendor=1050,serial=123456, path=1-2.3, class=hid or subsystem=tty
+func ParseUsbSelector(selector string) (UsbSelector, error) {
+	var s UsbSelector
+
+	if !strings.Contains(selector, "=") {
+		s.Vendor, s.Product, _ = strings.Cut(selector, ":")
+		return s, nil
+	}
+
+	for _, pair := range strings.Split(selector, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || value == "" {
+			return s, fmt.Errorf("invalid usb selector %s, expected key=value", pair)
+		}
+		switch key {
+		case "vendor":
+			s.Vendor = value
+		case "product":
+			s.Product = value
+		case "serial":
+			s.Serial = value
+		case "path":
+			s.Path = value
+		case "class":
+			if class, exists := usbClasses[strings.ToLower(value)]; exists {
+				value = class
+			}
+			if len(value) != 2 {
+				return s, fmt.Errorf("invalid usb class %s, expected a name or two hex digits", value)
+			}
+			s.Class = strings.ToLower(value)
+		case "subsystem":
+			s.Subsystem = value
+		default:
+			return s, fmt.Errorf("unknown usb selector key %s", key)
+		}
+	}
+
+	return s, nil
+}
+
+// Kernel name of the device, the bus and port path (e.g. 1-2.3)
+func UsbPath(dev *types.Device) string {
+	return filepath.Base(dev.Devpath)
+}
+
+// Device class, followed by the class of each interface
+func UsbClasses(dev *types.Device) []string {
+	var classes []string
+	if class, exists := dev.Attrs["bDeviceClass"]; exists && class != "00" {
+		classes = append(classes, class)
+	}
+
+	interfaces, _ := filepath.Glob(filepath.Join(dev.Devpath, "*:*", "bInterfaceClass"))
+	for _, path := range interfaces {
+		if class, err := os.ReadFile(path); err == nil && !slices.Contains(classes, strings.TrimSpace(string(class))) {
+			classes = append(classes, strings.TrimSpace(string(class)))
+		}
+	}
+	return classes
+}
+
+func usbSubsystems(dev *types.Device) []string {
+	var subsystems []string
+	for _, child := range dev.Children {
+		if subsystem, exists := child.Env["SUBSYSTEM"]; exists {
+			subsystems = append(subsystems, subsystem)
+		}
+		subsystems = append(subsystems, usbSubsystems(child)...)
+	}
+	return subsystems
+}
+
+// Implements matcher.Rule
+func (s UsbSelector) Match(dev *types.Device) bool {
+	if s.Vendor != "" && !strings.EqualFold(dev.Attrs["idVendor"], s.Vendor) {
+		return false
+	}
+	if s.Product != "" && !strings.EqualFold(dev.Attrs["idProduct"], s.Product) {
+		return false
+	}
+	if s.Serial != "" && dev.Attrs["serial"] != s.Serial {
+		return false
+	}
+	if s.Path != "" && UsbPath(dev) != s.Path {
+		return false
+	}
+	if s.Class != "" && !slices.Contains(UsbClasses(dev), s.Class) {
+		return false
+	}
+	if s.Subsystem != "" && !slices.Contains(usbSubsystems(dev), s.Subsystem) {
+		return false
+	}
+	return true
+}
+
 func extractDevicePaths(dev *types.Device) []string {
 	var paths []string
 
-	paths = append(paths, fmt.Sprintf("/dev/%s", dev.Env["DEVNAME"]))
+	// Interfaces and other nodes without a device file
+	if devname := dev.Env["DEVNAME"]; devname != "" {
+		paths = append(paths, fmt.Sprintf("/dev/%s", devname))
+	}
 
 	if len(dev.Children) > 0 {
 		for _, child := range dev.Children {
@@ -27,10 +155,10 @@ func extractDevicePaths(dev *types.Device) []string {
 	return paths
 }
 
-func UsbDevicePaths(idVendor string, idProduct string) []string {
+func UsbDevicePaths(selector UsbSelector) []string {
 	var paths []string
 
-	devices, err := UsbDevices(idVendor, idProduct)
+	devices, err := UsbDevices(selector)
 	if err != nil {
 		fmt.Println("Failed to list usb devices, ignoring.")
 		return []string{}
@@ -43,47 +171,89 @@ func UsbDevicePaths(idVendor string, idProduct string) []string {
 	return paths
 }
 
-func UsbDevices(idVendor string, idProduct string) ([]*types.Device, error) {
-	sc := libudev.NewScanner()
-	err, devices := sc.ScanDevices()
-
+func UsbDevices(selector UsbSelector) ([]*types.Device, error) {
+	devices, err := scanDevices()
 	if err != nil {
 		return nil, err
 	}
 
-	m := matcher.NewMatcher()
-	m.SetStrategy(matcher.StrategyAnd)
-	m.AddRule(matcher.NewRuleEnv("DEVNAME", "usb"))
+	// Stable order for listing
+	matched := matchDevices(devices, matcher.NewRuleEnv("DEVNAME", "usb"), selector)
+	slices.SortFunc(matched, func(a, b *types.Device) int {
+		return strings.Compare(UsbPath(a), UsbPath(b))
+	})
+	return matched, nil
+}
 
-	if idVendor != "" {
-		m.AddRule(matcher.NewRuleAttr("idVendor", idVendor))
-	}
-	if idProduct != "" {
-		m.AddRule(matcher.NewRuleAttr("idProduct", idProduct))
-	}
+// Adds the devices matching the selectors
+func addUsbDevices(spec *specgen.SpecGenerator, selectors []string) {
+	for _, usbDev := range selectors {
+		selector, err := ParseUsbSelector(usbDev)
+		if err != nil {
+			fmt.Println("Invalid usb device, ignoring: ", err)
+			continue
+		}
 
-	return m.Match(devices), nil
+		for _, devicePath := range UsbDevicePaths(selector) {
+			spec.Devices = append(spec.Devices, specs.LinuxDevice{
+				Path: devicePath,
+			})
+		}
+	}
 }
 
 func Usb(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	// Add usb devices
-	for _, usbDev := range containerConfig.Run.UsbDevices {
-		u := strings.Split(usbDev, ":")
-		var vendor string
-		var product string
-		if len(u) < 2 {
-			vendor = u[0]
-			// Catch all
-			product = ""
-		} else {
-			vendor = u[0]
-			product = u[1]
+	addUsbDevices(spec, containerConfig.Run.UsbDevices)
+}
+
+// Lists the usb devices matching any of the selectors, or all of them
+func ListUsb(selectors []string) error {
+	var parsed []UsbSelector
+	for _, selector := range selectors {
+		s, err := ParseUsbSelector(selector)
+		if err != nil {
+			return err
 		}
+		parsed = append(parsed, s)
+	}
+	if len(parsed) == 0 {
+		parsed = append(parsed, UsbSelector{})
+	}
 
-		for _, devicePath := range UsbDevicePaths(vendor, product) {
-			spec.Devices = append(spec.Devices, specs.LinuxDevice{
-				Path: devicePath,
-			})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "PATH\tID\tSERIAL\tCLASSES\tNAME\tNODES")
+	var listed []string
+	for _, selector := range parsed {
+		devices, err := UsbDevices(selector)
+		if err != nil {
+			return err
+		}
+
+		for _, dev := range devices {
+			if slices.Contains(listed, dev.Devpath) {
+				continue
+			}
+			listed = append(listed, dev.Devpath)
+
+			fmt.Fprintf(w, "%s\t%s:%s\t%s\t%s\t%s\t%s\n",
+				UsbPath(dev),
+				dev.Attrs["idVendor"],
+				dev.Attrs["idProduct"],
+				dev.Attrs["serial"],
+				strings.Join(UsbClasses(dev), ","),
+				strings.TrimSpace(dev.Attrs["manufacturer"]+" "+dev.Attrs["product"]),
+				strings.Join(extractDevicePaths(dev), ","),
+			)
 		}
 	}
+	return w.Flush()
+}
+
+func CmdExecuteUsbList(verbose bool, args []string) {
+	if err := ListUsb(args); err != nil {
+		fmt.Println("Failed to list usb devices")
+		fmt.Println("Error: ", err)
+		os.Exit(1)
+	}
 }
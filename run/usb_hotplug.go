@@ -0,0 +1,363 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/citilinkru/libudev/types"
+	"github.com/containers/podman/v6/pkg/bindings/containers"
+	entities "github.com/containers/podman/v6/pkg/domain/entities/types"
+	"github.com/julioln/sandman/config"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Devices plugged in while the container runs are created in its /dev, and only their own numbers are allowed in
+// its device cgroup, read and write, until they are unplugged. Block devices are never added.
+
+const (
+	ueventKernelGroup = 1
+	ueventBufferSize  = 64 * 1024
+	usbSysfsRoot      = "/sys"
+)
+
+// Creating device nodes in the running container needs root on the host, along with rootful podman
+var hostEuid = os.Geteuid
+
+// Parses a kernel uevent, ACTION@DEVPATH followed by NUL separated KEY=VALUE pairs
+func ParseUevent(message []byte) map[string]string {
+	var event = map[string]string{}
+	fields := bytes.Split(message, []byte{0})
+	if len(fields) == 0 || !bytes.Contains(fields[0], []byte("@")) {
+		// Not a kernel event
+		return event
+	}
+
+	for _, field := range fields[1:] {
+		if key, value, found := strings.Cut(string(field), "="); found {
+			event[key] = value
+		}
+	}
+	return event
+}
+
+func readSysfsAttrs(path string, names ...string) map[string]string {
+	var attrs = map[string]string{}
+	for _, name := range names {
+		if value, err := os.ReadFile(filepath.Join(path, name)); err == nil {
+			attrs[name] = strings.TrimSpace(string(value))
+		}
+	}
+	return attrs
+}
+
+// Finds the usb device a node belongs to, in the form the selectors match
+func hotplugUsbDevice(sysfsRoot string, event map[string]string) *types.Device {
+	for dir := filepath.Join(sysfsRoot, event["DEVPATH"]); dir != sysfsRoot && dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err != nil {
+			continue
+		}
+		return &types.Device{
+			Devpath: dir,
+			Env:     map[string]string{},
+			Attrs:   readSysfsAttrs(dir, "idVendor", "idProduct", "serial", "bDeviceClass"),
+			Children: []*types.Device{
+				{Env: map[string]string{"DEVNAME": event["DEVNAME"], "SUBSYSTEM": event["SUBSYSTEM"]}},
+			},
+		}
+	}
+	return nil
+}
+
+// Device cgroup rule of a host device node, as podman reports the container devices
+func deviceNodeRule(path string, access string) (specs.LinuxDeviceCgroup, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return specs.LinuxDeviceCgroup{}, err
+	}
+
+	var deviceType string
+	switch stat.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		deviceType = "c"
+	case unix.S_IFBLK:
+		deviceType = "b"
+	default:
+		return specs.LinuxDeviceCgroup{}, fmt.Errorf("%s is not a device", path)
+	}
+	major := int64(unix.Major(uint64(stat.Rdev)))
+	minor := int64(unix.Minor(uint64(stat.Rdev)))
+	return specs.LinuxDeviceCgroup{Allow: true, Type: deviceType, Major: &major, Minor: &minor, Access: access}, nil
+}
+
+// The device rules the container was created with, the hotplugged ones are added to them
+func containerDeviceRules(conn context.Context, containerID string) ([]specs.LinuxDeviceCgroup, error) {
+	containerData, err := containers.Inspect(conn, containerID, new(containers.InspectOptions))
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []specs.LinuxDeviceCgroup = []specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}}
+	if containerData.HostConfig == nil {
+		return rules, nil
+	}
+	for _, dev := range containerData.HostConfig.Devices {
+		rule, err := deviceNodeRule(dev.PathOnHost, dev.CgroupPermissions)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	for _, r := range containerData.HostConfig.DeviceCgroupRules {
+		rule, err := ParseDeviceCgroupRule(r)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Opens a directory of the container root, creating it. Paths resolve inside the root, so symlinks in the
+// container can't point these calls at host paths
+func openContainerDir(rootFd int, dir string) (int, error) {
+	how := &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	}
+
+	var parent string = "."
+	for _, name := range strings.Split(filepath.Clean(dir), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		parentFd, err := unix.Openat2(rootFd, parent, how)
+		if err != nil {
+			return -1, err
+		}
+		err = unix.Mkdirat(parentFd, name, 0755)
+		unix.Close(parentFd)
+		if err != nil && err != unix.EEXIST {
+			return -1, err
+		}
+		parent = filepath.Join(parent, name)
+	}
+	return unix.Openat2(rootFd, parent, how)
+}
+
+type usbHotplug struct {
+	root      string
+	sysfsRoot string
+	selectors []UsbSelector
+	nodes     map[string]string
+	baseRules []specs.LinuxDeviceCgroup
+	rules     map[string]specs.LinuxDeviceCgroup
+	update    func(rules []specs.LinuxDeviceCgroup) error
+	lock      sync.Mutex
+}
+
+func (h *usbHotplug) matches(event map[string]string) bool {
+	dev := hotplugUsbDevice(h.sysfsRoot, event)
+	if dev == nil {
+		return false
+	}
+	for _, selector := range h.selectors {
+		if selector.Match(dev) {
+			return true
+		}
+	}
+	return false
+}
+
+// The rules the container was created with, followed by the plugged devices in a stable order
+func (h *usbHotplug) cgroupRules() []specs.LinuxDeviceCgroup {
+	var devpaths []string
+	for devpath := range h.rules {
+		devpaths = append(devpaths, devpath)
+	}
+	slices.Sort(devpaths)
+
+	var rules []specs.LinuxDeviceCgroup = slices.Clone(h.baseRules)
+	for _, devpath := range devpaths {
+		rules = append(rules, h.rules[devpath])
+	}
+	return rules
+}
+
+func (h *usbHotplug) openDir(dir string) (int, error) {
+	rootFd, err := unix.Open(h.root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(rootFd)
+	return openContainerDir(rootFd, dir)
+}
+
+func (h *usbHotplug) mknod(dir string, name string, major uint64, minor uint64) error {
+	dirFd, err := h.openDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirFd)
+	unix.Unlinkat(dirFd, name, 0)
+	return unix.Mknodat(dirFd, name, unix.S_IFCHR|0666, int(unix.Mkdev(uint32(major), uint32(minor))))
+}
+
+// Creates or removes the container node of a device node event
+func (h *usbHotplug) handle(event map[string]string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var devname string = event["DEVNAME"]
+	if devname == "" || strings.Contains(devname, "..") || filepath.IsAbs(devname) {
+		return nil
+	}
+	var dir, name string = filepath.Split(filepath.Join("dev", devname))
+
+	switch event["ACTION"] {
+	case "add":
+		if event["SUBSYSTEM"] == "block" || !h.matches(event) {
+			return nil
+		}
+		major, err := strconv.ParseUint(event["MAJOR"], 10, 32)
+		if err != nil {
+			return nil
+		}
+		minor, err := strconv.ParseUint(event["MINOR"], 10, 32)
+		if err != nil {
+			return nil
+		}
+
+		// Allowed before the node exists, so the container never sees a node it can't open
+		ruleMajor, ruleMinor := int64(major), int64(minor)
+		h.rules[event["DEVPATH"]] = specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: &ruleMajor, Minor: &ruleMinor, Access: "rw"}
+		if err := h.update(h.cgroupRules()); err != nil {
+			delete(h.rules, event["DEVPATH"])
+			return fmt.Errorf("failed to allow %s: %w", devname, err)
+		}
+
+		if err := h.mknod(dir, name, major, minor); err != nil {
+			delete(h.rules, event["DEVPATH"])
+			h.update(h.cgroupRules())
+			return fmt.Errorf("failed to create %s: %w", devname, err)
+		}
+		h.nodes[event["DEVPATH"]] = filepath.Join(dir, name)
+		fmt.Println("Usb hotplug, added: ", devname)
+
+	case "remove":
+		created, exists := h.nodes[event["DEVPATH"]]
+		if !exists {
+			return nil
+		}
+		delete(h.nodes, event["DEVPATH"])
+		if dirFd, err := h.openDir(filepath.Dir(created)); err == nil {
+			unix.Unlinkat(dirFd, filepath.Base(created), 0)
+			unix.Close(dirFd)
+		}
+
+		delete(h.rules, event["DEVPATH"])
+		if err := h.update(h.cgroupRules()); err != nil {
+			return fmt.Errorf("failed to revoke %s: %w", devname, err)
+		}
+		fmt.Println("Usb hotplug, removed: ", devname)
+	}
+	return nil
+}
+
+func listenUevents() (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: ueventKernelGroup}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Non blocking, so closing the file stops a pending read
+	return os.NewFile(uintptr(fd), "uevent"), nil
+}
+
+// Fails before the sandbox is created when the hotplug can't create device nodes
+func PrepareUsbHotplug(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if !containerConfig.Run.UsbHotplug || len(containerConfig.Run.UsbDevices) == 0 {
+		return nil, nil
+	}
+	if hostEuid() != 0 {
+		return nil, fmt.Errorf("UsbHotplug requires running sandman as root with rootful podman, unset it for rootless sandboxes")
+	}
+	return nil, nil
+}
+
+// Watches usb events and mirrors the matching device nodes into the container
+func StartUsbHotplug(conn context.Context, containerID string, containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if !containerConfig.Run.UsbHotplug || len(containerConfig.Run.UsbDevices) == 0 {
+		return nil, nil
+	}
+
+	var selectors []UsbSelector
+	for _, usbDev := range containerConfig.Run.UsbDevices {
+		if selector, err := ParseUsbSelector(usbDev); err == nil {
+			selectors = append(selectors, selector)
+		}
+	}
+
+	pid, err := containerPid(conn, containerID)
+	if err != nil {
+		return nil, err
+	}
+	baseRules, err := containerDeviceRules(conn, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := listenUevents()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &usbHotplug{
+		// The container /dev, through its mount namespace
+		root:      fmt.Sprintf("/proc/%d/root", pid),
+		sysfsRoot: usbSysfsRoot,
+		selectors: selectors,
+		nodes:     map[string]string{},
+		baseRules: baseRules,
+		rules:     map[string]specs.LinuxDeviceCgroup{},
+		update: func(rules []specs.LinuxDeviceCgroup) error {
+			_, err := containers.Update(conn, &entities.ContainerUpdateOptions{
+				NameOrID:  containerID,
+				Resources: &specs.LinuxResources{Devices: rules},
+			})
+			return err
+		},
+	}
+
+	if verbose {
+		fmt.Println("Watching usb hotplug events for: ", containerConfig.Run.UsbDevices)
+	}
+
+	go func() {
+		buffer := make([]byte, ueventBufferSize)
+		for {
+			n, err := events.Read(buffer)
+			if err != nil {
+				return
+			}
+			// Creating nodes requires rootful podman
+			if err := h.handle(ParseUevent(buffer[:n])); err != nil {
+				fmt.Println("Usb hotplug failed: ", err)
+			}
+		}
+	}()
+
+	return func() {
+		events.Close()
+	}, nil
+}
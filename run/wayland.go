@@ -9,14 +9,58 @@ import (
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+func WaylandSocketPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/wayland", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
+func compositorSocketPath() string {
+	return fmt.Sprintf("%s/%s", os.Getenv("XDG_RUNTIME_DIR"), os.Getenv("WAYLAND_DISPLAY"))
+}
+
 func Wayland(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	if containerConfig.Run.Wayland {
+		var source string = compositorSocketPath()
+		if containerConfig.Run.WaylandSecurityContext {
+			// Restricted socket created by PrepareWayland
+			source = WaylandSocketPath(containerConfig)
+		}
+
 		spec.Env["WAYLAND_DISPLAY"] = os.Getenv("WAYLAND_DISPLAY")
 		spec.Env["XDG_SESSION_TYPE"] = os.Getenv("XDG_SESSION_TYPE")
 		spec.Mounts = append(spec.Mounts, specs.Mount{
-			Destination: fmt.Sprintf("%s/%s", os.Getenv("XDG_RUNTIME_DIR"), os.Getenv("WAYLAND_DISPLAY")),
-			Source:      fmt.Sprintf("%s/%s", os.Getenv("XDG_RUNTIME_DIR"), os.Getenv("WAYLAND_DISPLAY")),
+			Destination: compositorSocketPath(),
+			Source:      source,
 			Type:        "bind",
 		})
 	}
 }
+
+func PrepareWayland(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if !containerConfig.Run.Wayland || !containerConfig.Run.WaylandSecurityContext {
+		return nil, nil
+	}
+
+	var path string = WaylandSocketPath(containerConfig)
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+
+	stop, err := CreateSecurityContext(compositorSocketPath(), path, containerConfig.Name)
+	if err != nil {
+		fmt.Println("Warning: can't create a restricted Wayland socket, the sandbox gets full compositor access")
+		fmt.Println("Error: ", err)
+
+		// Bind mounts follow symlinks, so this mounts the compositor socket
+		os.Remove(path)
+		if err := os.Symlink(compositorSocketPath(), path); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if verbose {
+		fmt.Println("Wayland security context socket: ", path)
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,264 @@
+package run
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Minimal Wayland client, just enough to create a wp_security_context_v1 listener
+
+const (
+	waylandDisplayID = 1
+
+	waylandDisplaySync        = 0
+	waylandDisplayGetRegistry = 1
+	waylandDisplayErrorEvent  = 0
+	waylandRegistryBind       = 0
+	waylandRegistryGlobal     = 0
+	waylandCallbackDone       = 0
+
+	securityContextManagerInterface      = "wp_security_context_manager_v1"
+	securityContextManagerDestroy        = 0
+	securityContextManagerCreateListener = 1
+	securityContextDestroy               = 0
+	securityContextSetSandboxEngine      = 1
+	securityContextSetAppID              = 2
+	securityContextCommit                = 4
+
+	securityContextSandboxEngine = "sandman"
+)
+
+var ErrSecurityContextUnsupported = errors.New("compositor does not support " + securityContextManagerInterface)
+
+type waylandConn struct {
+	conn   *net.UnixConn
+	nextID uint32
+}
+
+type waylandEvent struct {
+	object uint32
+	opcode uint16
+	args   []byte
+}
+
+func waylandUint(v uint32) []byte {
+	return binary.NativeEndian.AppendUint32(nil, v)
+}
+
+// Strings are NUL terminated, prefixed by their length and padded to 32 bits
+func waylandString(s string) []byte {
+	arg := waylandUint(uint32(len(s) + 1))
+	arg = append(arg, s...)
+	arg = append(arg, 0)
+	for len(arg)%4 != 0 {
+		arg = append(arg, 0)
+	}
+	return arg
+}
+
+func parseWaylandUint(args []byte) (uint32, []byte, error) {
+	if len(args) < 4 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return binary.NativeEndian.Uint32(args), args[4:], nil
+}
+
+func parseWaylandString(args []byte) (string, []byte, error) {
+	length, args, err := parseWaylandUint(args)
+	if err != nil {
+		return "", nil, err
+	}
+	padded := (int(length) + 3) &^ 3
+	if length == 0 || len(args) < padded {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return string(args[:length-1]), args[padded:], nil
+}
+
+func (w *waylandConn) newID() uint32 {
+	w.nextID++
+	return w.nextID
+}
+
+func (w *waylandConn) send(object uint32, opcode uint16, args []byte, fds ...int) error {
+	var oob []byte
+	message := waylandUint(object)
+	message = append(message, waylandUint(uint32(8+len(args))<<16|uint32(opcode))...)
+	message = append(message, args...)
+
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	_, _, err := w.conn.WriteMsgUnix(message, oob, nil)
+	return err
+}
+
+func (w *waylandConn) read() (waylandEvent, error) {
+	var event waylandEvent
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(w.conn, header); err != nil {
+		return event, err
+	}
+
+	event.object = binary.NativeEndian.Uint32(header)
+	sizeOpcode := binary.NativeEndian.Uint32(header[4:])
+	event.opcode = uint16(sizeOpcode & 0xffff)
+	size := sizeOpcode >> 16
+	if size < 8 {
+		return event, fmt.Errorf("invalid wayland message size %d", size)
+	}
+
+	event.args = make([]byte, size-8)
+	_, err := io.ReadFull(w.conn, event.args)
+	return event, err
+}
+
+// Waits until the compositor processed every request sent so far
+func (w *waylandConn) roundtrip(handle func(event waylandEvent) error) error {
+	callback := w.newID()
+	if err := w.send(waylandDisplayID, waylandDisplaySync, waylandUint(callback)); err != nil {
+		return err
+	}
+
+	for {
+		event, err := w.read()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case event.object == callback && event.opcode == waylandCallbackDone:
+			return nil
+		case event.object == waylandDisplayID && event.opcode == waylandDisplayErrorEvent:
+			args := event.args
+			object, args, _ := parseWaylandUint(args)
+			code, args, _ := parseWaylandUint(args)
+			message, _, _ := parseWaylandString(args)
+			return fmt.Errorf("wayland error on object %d, code %d: %s", object, code, message)
+		default:
+			if err := handle(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Creates a restricted listening socket at listenPath tagged with the app id, served by the compositor.
+func CreateSecurityContext(compositorSocket string, listenPath string, appID string) (func(), error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: compositorSocket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	w := &waylandConn{conn: conn, nextID: waylandDisplayID}
+
+	stop := func() {
+		conn.Close()
+	}
+
+	registry := w.newID()
+	if err := w.send(waylandDisplayID, waylandDisplayGetRegistry, waylandUint(registry)); err != nil {
+		stop()
+		return nil, err
+	}
+
+	var managerName uint32
+	var found bool
+	err = w.roundtrip(func(event waylandEvent) error {
+		if event.object != registry || event.opcode != waylandRegistryGlobal {
+			return nil
+		}
+		name, args, err := parseWaylandUint(event.args)
+		if err != nil {
+			return err
+		}
+		iface, _, err := parseWaylandString(args)
+		if err != nil {
+			return err
+		}
+		if iface == securityContextManagerInterface {
+			managerName = name
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	if !found {
+		stop()
+		return nil, ErrSecurityContextUnsupported
+	}
+
+	manager := w.newID()
+	bindArgs := waylandUint(managerName)
+	bindArgs = append(bindArgs, waylandString(securityContextManagerInterface)...)
+	bindArgs = append(bindArgs, waylandUint(1)...)
+	bindArgs = append(bindArgs, waylandUint(manager)...)
+	if err := w.send(registry, waylandRegistryBind, bindArgs); err != nil {
+		stop()
+		return nil, err
+	}
+
+	// The compositor accepts clients on the listener until the other end of the pipe is closed
+	listener, err := listenSandboxSocket(listenPath)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	defer listener.Close()
+
+	listenFile, err := listener.File()
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	defer listenFile.Close()
+
+	closeRead, closeWrite, err := os.Pipe()
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	defer closeRead.Close()
+
+	stop = func() {
+		closeWrite.Close()
+		conn.Close()
+		os.Remove(listenPath)
+	}
+
+	securityContext := w.newID()
+	requests := []struct {
+		object uint32
+		opcode uint16
+		args   []byte
+		fds    []int
+	}{
+		{manager, securityContextManagerCreateListener, waylandUint(securityContext), []int{int(listenFile.Fd()), int(closeRead.Fd())}},
+		{securityContext, securityContextSetSandboxEngine, waylandString(securityContextSandboxEngine), nil},
+		{securityContext, securityContextSetAppID, waylandString(appID), nil},
+		{securityContext, securityContextCommit, nil, nil},
+		{securityContext, securityContextDestroy, nil, nil},
+		{manager, securityContextManagerDestroy, nil, nil},
+	}
+	for _, request := range requests {
+		if err := w.send(request.object, request.opcode, request.args, request.fds...); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+
+	if err := w.roundtrip(func(event waylandEvent) error { return nil }); err != nil {
+		stop()
+		return nil, err
+	}
+
+	return stop, nil
+}
@@ -1,23 +1,146 @@
 package run
 
 import (
+	"bytes"
+	"fmt"
 	"os"
+	"os/exec"
+	"strings"
 
 	"github.com/containers/podman/v6/pkg/specgen"
 	"github.com/julioln/sandman/config"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+const xauthorityDestination = "/tmp/.sandman-Xauthority"
+
+func XauthorityPath(containerConfig config.ContainerConfig) string {
+	return fmt.Sprintf("%s/Xauthority", config.GetSandboxRuntimeDir(containerConfig.Name))
+}
+
+// Returns the display number of a local display (e.g. :0, :1.0 or unix:2)
+func X11DisplayNumber(display string) (string, bool) {
+	i := strings.LastIndex(display, ":")
+	if i < 0 {
+		return "", false
+	}
+
+	host := display[:i]
+	if host != "" && host != "unix" {
+		// TCP displays have no socket
+		return "", false
+	}
+
+	number, _, _ := strings.Cut(display[i+1:], ".")
+	if number == "" {
+		return "", false
+	}
+	return number, true
+}
+
 func X11(spec *specgen.SpecGenerator, containerConfig config.ContainerConfig) {
 	if containerConfig.Run.X11 {
 		spec.Env["DISPLAY"] = os.Getenv("DISPLAY")
 		spec.Env["XDG_SESSION_TYPE"] = os.Getenv("XDG_SESSION_TYPE")
 		spec.Env["XCURSOR_THEME"] = os.Getenv("XCURSOR_THEME")
 		spec.Env["XCURSOR_SIZE"] = os.Getenv("XCURSOR_SIZE")
+		spec.Env["XAUTHORITY"] = xauthorityDestination
+
+		// Only the socket of the current display
+		if number, local := X11DisplayNumber(os.Getenv("DISPLAY")); local {
+			spec.Mounts = append(spec.Mounts, specs.Mount{
+				Destination: fmt.Sprintf("/tmp/.X11-unix/X%s", number),
+				Source:      fmt.Sprintf("/tmp/.X11-unix/X%s", number),
+				Type:        "bind",
+			})
+		}
+
 		spec.Mounts = append(spec.Mounts, specs.Mount{
-			Destination: "/tmp/.X11-unix",
-			Source:      "/tmp/.X11-unix",
+			Destination: xauthorityDestination,
+			Source:      XauthorityPath(containerConfig),
 			Type:        "bind",
+			Options:     []string{"ro"},
 		})
 	}
 }
+
+// Lists the cookies for the display with a wildcard address family, so they match any container hostname
+func xauthCookies(display string, args ...string) ([]byte, error) {
+	var cookies bytes.Buffer
+
+	args = append(args, "nlist", display)
+	output, err := exec.Command("xauth", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if len(line) < 4 {
+			continue
+		}
+		cookies.WriteString("ffff")
+		cookies.WriteString(line[4:])
+		cookies.WriteString("\n")
+	}
+
+	if cookies.Len() == 0 {
+		return nil, fmt.Errorf("no cookie found for display %s", display)
+	}
+
+	return cookies.Bytes(), nil
+}
+
+func PrepareX11(containerConfig config.ContainerConfig, verbose bool) (func(), error) {
+	if !containerConfig.Run.X11 {
+		return nil, nil
+	}
+
+	var display string = os.Getenv("DISPLAY")
+	var path string = XauthorityPath(containerConfig)
+
+	if err := os.MkdirAll(config.GetSandboxRuntimeDir(containerConfig.Name), 0700); err != nil {
+		return nil, err
+	}
+
+	// Always create it, the mount fails otherwise
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		return nil, err
+	}
+
+	// The host cookie gives full access to the display, only when asked for or when no untrusted one can be made
+	var cookies []byte
+	var revoke func()
+	var err error
+	var trusted bool = containerConfig.Run.X11Trusted
+	if !trusted {
+		if cookies, revoke, err = untrustedCookies(display); err != nil {
+			// The clipboard relay relies on the SECURITY extension hiding the host clipboard
+			if clipboardRestricted(containerConfig) {
+				return nil, fmt.Errorf("failed to generate an untrusted X11 cookie, needed by Clipboard %s: %w", containerConfig.Run.Clipboard, err)
+			}
+			fmt.Println("Warning: failed to generate an untrusted X11 cookie, the sandbox gets the host one: ", err)
+			trusted = true
+		}
+	}
+	if trusted {
+		if cookies, err = xauthCookies(display); err != nil {
+			fmt.Println("Failed to read the host X11 cookie, relying on the display access control: ", err)
+			return nil, nil
+		}
+	}
+
+	cmd := exec.Command("xauth", "-q", "-f", path, "nmerge", "-")
+	cmd.Stdin = bytes.NewReader(cookies)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if revoke != nil {
+			revoke()
+		}
+		return nil, fmt.Errorf("failed to write Xauthority: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	if verbose {
+		fmt.Println("Xauthority: ", path)
+	}
+
+	return revoke, nil
+}
@@ -0,0 +1,245 @@
+package run
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Untrusted cookies are generated through the X11 SECURITY extension, as `xauth generate` does, keeping their id
+// so they are revoked when the sandbox exits. The server would otherwise accept them until it resets.
+
+// Sockets of the local displays
+var x11SocketDir = "/tmp/.X11-unix"
+
+const (
+	x11CookieName   = "MIT-MAGIC-COOKIE-1"
+	x11Extension    = "SECURITY"
+	x11ReplySize    = 32
+	x11SetupSuccess = 1
+
+	x11QueryExtension                = 98
+	x11SecurityGenerateAuthorization = 1
+	x11SecurityRevokeAuthorization   = 2
+
+	// Value mask of GenerateAuthorization, values follow in bit order
+	x11SecurityTimeout    = 1 << 0
+	x11SecurityTrustLevel = 1 << 1
+	x11SecurityUntrusted  = 1
+)
+
+type x11Conn struct {
+	conn   net.Conn
+	opcode byte
+}
+
+func x11Padded(data []byte) []byte {
+	return append(data, make([]byte, (4-len(data)%4)%4)...)
+}
+
+// Parses a line of `xauth nlist`: family, then address, display number, protocol name and data, each as a hex
+// length followed by the hex value. Empty values leave two spaces
+func parseXauthEntry(line string) (string, []byte, error) {
+	var fields []string = strings.Split(strings.TrimSpace(line), " ")
+	if len(fields) != 9 {
+		return "", nil, fmt.Errorf("invalid xauth entry %q", line)
+	}
+
+	var values [][]byte
+	for i := 1; i < len(fields); i += 2 {
+		size, err := strconv.ParseUint(fields[i], 16, 16)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid xauth entry %q", line)
+		}
+		value, err := hex.DecodeString(fields[i+1])
+		if err != nil || len(value) != int(size) {
+			return "", nil, fmt.Errorf("invalid xauth entry %q", line)
+		}
+		values = append(values, value)
+	}
+	return string(values[2]), values[3], nil
+}
+
+// An xauth nlist entry for any host, readable by `xauth nmerge`
+func xauthEntry(number string, name string, data []byte) string {
+	return fmt.Sprintf("ffff 0000  %04x %s %04x %s %04x %s\n",
+		len(number), hex.EncodeToString([]byte(number)),
+		len(name), hex.EncodeToString([]byte(name)),
+		len(data), hex.EncodeToString(data))
+}
+
+// Connects to a local display, authenticating with the host cookie when there is one
+func dialX11(display string) (*x11Conn, error) {
+	number, local := X11DisplayNumber(display)
+	if !local {
+		return nil, fmt.Errorf("display %s is not local", display)
+	}
+
+	var authName string
+	var authData []byte
+	if cookies, err := xauthCookies(display); err == nil {
+		line, _, _ := strings.Cut(string(cookies), "\n")
+		if authName, authData, err = parseXauthEntry(line); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.Dial("unix", fmt.Sprintf("%s/X%s", x11SocketDir, number))
+	if err != nil {
+		return nil, err
+	}
+
+	// Little endian, protocol 11.0
+	setup := []byte{'l', 0}
+	setup = binary.LittleEndian.AppendUint16(setup, 11)
+	setup = binary.LittleEndian.AppendUint16(setup, 0)
+	setup = binary.LittleEndian.AppendUint16(setup, uint16(len(authName)))
+	setup = binary.LittleEndian.AppendUint16(setup, uint16(len(authData)))
+	setup = append(setup, 0, 0)
+	setup = append(setup, x11Padded([]byte(authName))...)
+	setup = append(setup, x11Padded(authData)...)
+	if _, err := conn.Write(setup); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	additional := make([]byte, int(binary.LittleEndian.Uint16(header[6:]))*4)
+	if _, err := io.ReadFull(conn, additional); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if header[0] != x11SetupSuccess {
+		conn.Close()
+		reason := additional[:min(int(header[1]), len(additional))]
+		return nil, fmt.Errorf("display %s refused the connection: %s", display, strings.TrimSpace(string(reason)))
+	}
+
+	x := &x11Conn{conn: conn}
+	if x.opcode, err = x.queryExtension(x11Extension); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// Sends a request, the length in 4 byte units is filled in
+func (x *x11Conn) send(request []byte) error {
+	request = x11Padded(request)
+	binary.LittleEndian.PutUint16(request[2:], uint16(len(request)/4))
+	_, err := x.conn.Write(request)
+	return err
+}
+
+// Reads the next reply, skipping events
+func (x *x11Conn) reply() ([]byte, error) {
+	for {
+		reply := make([]byte, x11ReplySize)
+		if _, err := io.ReadFull(x.conn, reply); err != nil {
+			return nil, err
+		}
+		switch reply[0] {
+		case 0:
+			return nil, fmt.Errorf("X11 error %d, major opcode %d", reply[1], reply[10])
+		case 1:
+			extra := make([]byte, int(binary.LittleEndian.Uint32(reply[4:]))*4)
+			if _, err := io.ReadFull(x.conn, extra); err != nil {
+				return nil, err
+			}
+			return append(reply, extra...), nil
+		}
+	}
+}
+
+func (x *x11Conn) queryExtension(name string) (byte, error) {
+	request := []byte{x11QueryExtension, 0, 0, 0}
+	request = binary.LittleEndian.AppendUint16(request, uint16(len(name)))
+	request = append(request, 0, 0)
+	request = append(request, name...)
+	if err := x.send(request); err != nil {
+		return 0, err
+	}
+
+	reply, err := x.reply()
+	if err != nil {
+		return 0, err
+	}
+	if reply[8] == 0 {
+		return 0, fmt.Errorf("the X server has no %s extension", name)
+	}
+	return reply[9], nil
+}
+
+// Generates an untrusted cookie that never expires, returning its id and data
+func (x *x11Conn) generateUntrusted() (uint32, []byte, error) {
+	request := []byte{x.opcode, x11SecurityGenerateAuthorization, 0, 0}
+	request = binary.LittleEndian.AppendUint16(request, uint16(len(x11CookieName)))
+	// The server generates the data
+	request = binary.LittleEndian.AppendUint16(request, 0)
+	request = binary.LittleEndian.AppendUint32(request, x11SecurityTimeout|x11SecurityTrustLevel)
+	request = append(request, x11Padded([]byte(x11CookieName))...)
+	request = binary.LittleEndian.AppendUint32(request, 0)
+	request = binary.LittleEndian.AppendUint32(request, x11SecurityUntrusted)
+	if err := x.send(request); err != nil {
+		return 0, nil, err
+	}
+
+	reply, err := x.reply()
+	if err != nil {
+		return 0, nil, err
+	}
+	id := binary.LittleEndian.Uint32(reply[8:])
+	size := int(binary.LittleEndian.Uint16(reply[12:]))
+	if x11ReplySize+size > len(reply) {
+		return 0, nil, fmt.Errorf("invalid authorization reply")
+	}
+	return id, reply[x11ReplySize : x11ReplySize+size], nil
+}
+
+// Revokes a generated cookie, clients using it are disconnected
+func (x *x11Conn) revoke(id uint32) error {
+	request := []byte{x.opcode, x11SecurityRevokeAuthorization, 0, 0}
+	request = binary.LittleEndian.AppendUint32(request, id)
+	if err := x.send(request); err != nil {
+		return err
+	}
+	// A round trip, so the revocation is processed or its error received
+	_, err := x.queryExtension(x11Extension)
+	return err
+}
+
+// Generates an untrusted cookie for the display, in xauth nlist form, and a function revoking it
+func untrustedCookies(display string) ([]byte, func(), error) {
+	x, err := dialX11(display)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer x.conn.Close()
+
+	id, cookie, err := x.generateUntrusted()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	number, _ := X11DisplayNumber(display)
+	revoke := func() {
+		x, err := dialX11(display)
+		if err != nil {
+			fmt.Println("Failed to revoke the untrusted X11 cookie: ", err)
+			return
+		}
+		defer x.conn.Close()
+		if err := x.revoke(id); err != nil {
+			fmt.Println("Failed to revoke the untrusted X11 cookie: ", err)
+		}
+	}
+	return []byte(xauthEntry(number, x11CookieName, cookie)), revoke, nil
+}